@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/grandcat/zeroconf"
+	homie "github.com/jbonachera/homie-go/homie"
+	"github.com/spf13/viper"
+)
+
+type broker struct {
+	URL      string `mapstructure:"url"`
+	Priority int    `mapstructure:"priority"`
+}
+
+// configuredBrokers returns mqtt.brokers sorted by priority, lowest value
+// first. mqtt.broker is still honored when no list is configured.
+func configuredBrokers(config *viper.Viper) []broker {
+	brokers := []broker{}
+	if err := config.UnmarshalKey("mqtt.brokers", &brokers); err != nil {
+		log.Errorf("failed to parse mqtt.brokers: %v", err)
+	}
+	if len(brokers) == 0 && config.GetString("mqtt.broker") != "" {
+		brokers = append(brokers, broker{URL: config.GetString("mqtt.broker")})
+	}
+	sortBrokers(brokers)
+	return brokers
+}
+
+func sortBrokers(brokers []broker) {
+	sort.SliceStable(brokers, func(i, j int) bool {
+		return brokers[i].Priority < brokers[j].Priority
+	})
+}
+
+// discoverBrokers browses the local network for _mqtt._tcp services.
+func discoverBrokers(ctx context.Context, timeout time.Duration, priority int) ([]broker, error) {
+	resolver, err := zeroconf.NewResolver()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	entries := make(chan *zeroconf.ServiceEntry)
+	brokers := []broker{}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for entry := range entries {
+			host := entry.HostName
+			if len(entry.AddrIPv4) > 0 {
+				host = entry.AddrIPv4[0].String()
+			}
+			if host == "" {
+				continue
+			}
+			brokers = append(brokers, broker{
+				URL:      fmt.Sprintf("tcp://%s", net.JoinHostPort(host, strconv.Itoa(entry.Port))),
+				Priority: priority,
+			})
+		}
+	}()
+	err = resolver.Browse(ctx, "_mqtt._tcp", "local.", entries)
+	if err != nil {
+		return nil, err
+	}
+	<-ctx.Done()
+	<-done
+	return brokers, nil
+}
+
+// backoff computes exponentially growing delays between min and max, with up
+// to 50% of random jitter.
+type backoff struct {
+	min     time.Duration
+	max     time.Duration
+	current time.Duration
+}
+
+func (b *backoff) Next() time.Duration {
+	if b.current < b.min {
+		b.current = b.min
+	} else {
+		b.current *= 2
+		if b.current > b.max {
+			b.current = b.max
+		}
+	}
+	jitter := time.Duration(rand.Int63n(int64(b.current)/2 + 1))
+	return b.current/2 + jitter
+}
+
+func (b *backoff) Reset() {
+	b.current = 0
+}
+
+// failureNotifier forwards connection failures to notify, at most once per
+// interval.
+type failureNotifier struct {
+	mtx      sync.Mutex
+	notify   func(string)
+	interval time.Duration
+	last     time.Time
+	failures int
+}
+
+func (n *failureNotifier) Failed(err error) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	n.failures++
+	if time.Since(n.last) < n.interval {
+		return
+	}
+	n.last = time.Now()
+	if n.failures == 1 {
+		n.notify(fmt.Sprintf("connection failed: %v", err))
+	} else {
+		n.notify(fmt.Sprintf("connection failed %d times: %v", n.failures, err))
+	}
+}
+
+// Reset returns how many failures happened since the last successful
+// connection.
+func (n *failureNotifier) Reset() int {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	failures := n.failures
+	n.failures = 0
+	n.last = time.Time{}
+	return failures
+}
+
+type connectionState struct {
+	Broker      string    `json:"broker"`
+	ConnectedAt time.Time `json:"connectedAt"`
+	Failures    int       `json:"failures"`
+}
+
+// connect tries every known broker in priority order, waiting longer and
+// longer between rounds, until one accepts the connection or ctx is done.
+func connect(ctx context.Context, config *viper.Viper, device homie.Device, deviceConfig *homie.Config, certificates *tlsLoader, notifier *failureNotifier) error {
+	delays := &backoff{
+		min: config.GetDuration("mqtt.backoff.min"),
+		max: config.GetDuration("mqtt.backoff.max"),
+	}
+	for {
+		brokers := configuredBrokers(config)
+		if config.GetBool("mqtt.discovery.enabled") {
+			discovered, err := discoverBrokers(ctx, config.GetDuration("mqtt.discovery.timeout"), config.GetInt("mqtt.discovery.priority"))
+			if err != nil {
+				log.Warnf("broker discovery failed: %v", err)
+			}
+			brokers = append(brokers, discovered...)
+			sortBrokers(brokers)
+		}
+		if len(brokers) == 0 {
+			log.Warnf("no MQTT broker configured or discovered")
+		}
+		proxy, err := proxyURL(config)
+		if err != nil {
+			log.Errorf("%v", err)
+		}
+		for _, b := range brokers {
+			deviceConfig.Mqtt.URL = b.URL
+			deviceConfig.Mqtt.TLSConfig = nil
+			deviceConfig.Mqtt.WebsocketOptions = websocketOptions(proxy)
+			if isTLSBroker(b.URL) && certificates != nil {
+				tlsConfig, err := certificates.Config(b.URL)
+				if err != nil {
+					log.Errorf("failed to build TLS configuration for %s: %v", b.URL, err)
+					continue
+				}
+				deviceConfig.Mqtt.TLSConfig = tlsConfig
+			}
+			log.Infof("attempting to connect to %s", b.URL)
+			connectionAttempts.Inc()
+			err := device.Connect()
+			if err == nil {
+				return nil
+			}
+			log.Errorf("failed to connect to %s: %v", b.URL, err)
+			connectionFailures.Inc()
+			notifier.Failed(err)
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+		}
+		delay := delays.Next()
+		log.Warnf("no broker reachable, retrying in %s", delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	homie "github.com/jbonachera/homie-go/homie"
+	"github.com/jbonachera/mqtt-laptop-agent/logging"
+	"github.com/jbonachera/mqtt-laptop-agent/provider"
+	"github.com/jbonachera/mqtt-laptop-agent/queue"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+type kind int
+
+const (
+	stringKind kind = iota
+	boolKind
+	intKind
+	durationKind
+	stringListKind
+	levelKind
+	policiesKind
+	brokersKind
+)
+
+type setting struct {
+	kind        kind
+	description string
+}
+
+// configSchema lists every setting the agent understands. Provider settings
+// are checked separately, under providers.<name>.
+var configSchema = map[string]setting{
+	"homie.name":              {stringKind, "device name, used in MQTT topics"},
+	"mqtt.broker":             {stringKind, "broker URL, used when mqtt.brokers is empty"},
+	"mqtt.brokers":            {brokersKind, "brokers to try in order of priority, lowest first"},
+	"mqtt.username":           {stringKind, "MQTT username"},
+	"mqtt.password":           {stringKind, "MQTT password"},
+	"mqtt.proxy":              {stringKind, "HTTP proxy URL used to reach ws:// and wss:// brokers"},
+	"mqtt.backoff.min":        {durationKind, "first delay between connection rounds"},
+	"mqtt.backoff.max":        {durationKind, "longest delay between connection rounds"},
+	"mqtt.notify-interval":    {durationKind, "minimum delay between two connection failure notifications"},
+	"mqtt.discovery.enabled":  {boolKind, "look for _mqtt._tcp brokers on the local network"},
+	"mqtt.discovery.timeout":  {durationKind, "how long to browse for brokers"},
+	"mqtt.discovery.priority": {intKind, "priority given to discovered brokers"},
+	"webcam-path":             {stringKind, "deprecated, use providers.webcam.path"},
+	"ota.trusted-keys":        {stringListKind, "base64 ed25519 public keys allowed to sign firmwares"},
+	"ota.health-timeout":      {durationKind, "how long a new firmware has to connect before being rolled back"},
+	"ota.history-size":        {intKind, "number of OTA results kept"},
+	"ota.channel":             {stringKind, "release channel followed by this device"},
+	"ota.signing-key":         {stringKind, "private key used by ota push"},
+	"enroll.topic":            {stringKind, "topic prefix of the enrollment service"},
+	"shutdown-timeout":        {durationKind, "how long providers are given to stop"},
+	"queue.size":              {intKind, "maximum number of messages kept while offline"},
+	"queue.persist":           {boolKind, "keep offline messages on disk"},
+	"queue.policies":          {policiesKind, "latest or history, by <node>/<property>"},
+	"http.listen":             {stringKind, "address of the health and metrics endpoint, disabled when empty"},
+	"http.unhealthy-after":    {durationKind, "how long the agent may stay disconnected before /healthz fails"},
+	"log.level":               {levelKind, "minimum level of local logs"},
+	"log.remote-level":        {levelKind, "minimum level of logs published over MQTT"},
+	"hass.enabled":            {boolKind, "publish Home Assistant discovery configs"},
+	"hass.prefix":             {stringKind, "Home Assistant discovery prefix"},
+	"broadcast.groups":        {stringListKind, "groups targeted by group/<group>/<level> broadcasts"},
+	"broadcast.tags":          {stringListKind, "tags targeted by tag/<tag>/<level> broadcasts"},
+	"rpc.response-prefixes":   {stringListKind, "topic prefixes RPC responses may be published below, besides $rpc/"},
+}
+
+// secretSettings are never published over MQTT.
+var secretSettings = []string{"mqtt.password"}
+
+func configPath() string {
+	return path.Join(configDir(), "config.yaml")
+}
+
+// flattenSettings turns nested settings into dotted keys. Maps of the kinds
+// which expect a map are kept whole.
+func flattenSettings(prefix string, settings map[string]interface{}, flat map[string]interface{}) {
+	for key, value := range settings {
+		key = strings.ToLower(prefix + key)
+		if nested, ok := value.(map[string]interface{}); ok {
+			if s, known := configSchema[key]; !known || s.kind != policiesKind {
+				flattenSettings(key+".", nested, flat)
+				continue
+			}
+		}
+		flat[key] = value
+	}
+}
+
+func checkKind(k kind, value interface{}) error {
+	switch k {
+	case stringKind:
+		if _, ok := value.(string); !ok {
+			return fmt.Errorf("expected a string, got %T", value)
+		}
+	case boolKind:
+		switch v := value.(type) {
+		case bool:
+		case string:
+			if v != "true" && v != "false" {
+				return fmt.Errorf("expected a boolean, got %q", v)
+			}
+		default:
+			return fmt.Errorf("expected a boolean, got %T", value)
+		}
+	case intKind:
+		switch v := value.(type) {
+		case int, int64:
+		case float64:
+			if v != float64(int64(v)) {
+				return fmt.Errorf("expected an integer, got %v", v)
+			}
+		default:
+			return fmt.Errorf("expected an integer, got %T", value)
+		}
+	case durationKind:
+		switch v := value.(type) {
+		case int, int64, float64, time.Duration:
+		case string:
+			if _, err := time.ParseDuration(v); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("expected a duration, got %T", value)
+		}
+	case stringListKind:
+		switch v := value.(type) {
+		case []string:
+		case []interface{}:
+			for _, item := range v {
+				if _, ok := item.(string); !ok {
+					return fmt.Errorf("expected a list of strings, got a %T item", item)
+				}
+			}
+		default:
+			return fmt.Errorf("expected a list of strings, got %T", value)
+		}
+	case levelKind:
+		v, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("expected a log level, got %T", value)
+		}
+		if _, err := logging.ParseLevel(v); err != nil {
+			return err
+		}
+	case policiesKind:
+		policies, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("expected a map of queue policies, got %T", value)
+		}
+		for property, policy := range policies {
+			if _, err := queue.ParsePolicy(fmt.Sprintf("%v", policy)); err != nil {
+				return fmt.Errorf("%s: %v", property, err)
+			}
+		}
+	case brokersKind:
+		brokers, ok := value.([]interface{})
+		if !ok {
+			return fmt.Errorf("expected a list of brokers, got %T", value)
+		}
+		for _, item := range brokers {
+			b, ok := item.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("expected a broker with url and priority, got %T", item)
+			}
+			if err := checkKind(stringKind, b["url"]); err != nil {
+				return fmt.Errorf("url: %v", err)
+			}
+			if err := checkBrokerURL(b["url"].(string)); err != nil {
+				return err
+			}
+			if priority, ok := b["priority"]; ok {
+				if err := checkKind(intKind, priority); err != nil {
+					return fmt.Errorf("priority: %v", err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// validateSettings checks nested settings against configSchema and the
+// registered providers.
+func validateSettings(settings map[string]interface{}) []error {
+	flat := map[string]interface{}{}
+	flattenSettings("", settings, flat)
+	keys := make([]string, 0, len(flat))
+	for key := range flat {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	providers := map[string]bool{}
+	for _, name := range provider.Names() {
+		providers[name] = true
+	}
+	errs := []error{}
+	for _, key := range keys {
+		if strings.HasPrefix(key, "providers.") {
+			tokens := strings.SplitN(key, ".", 3)
+			if len(tokens) < 3 || !providers[tokens[1]] {
+				errs = append(errs, fmt.Errorf("%s: unknown provider", key))
+			} else if tokens[2] == "enabled" {
+				if err := checkKind(boolKind, flat[key]); err != nil {
+					errs = append(errs, fmt.Errorf("%s: %v", key, err))
+				}
+			}
+			continue
+		}
+		s, ok := configSchema[key]
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: unknown setting", key))
+			continue
+		}
+		if err := checkKind(s.kind, flat[key]); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", key, err))
+		}
+	}
+	return errs
+}
+
+// validateFile checks the settings stored in a configuration file, leaving
+// defaults and flags aside.
+func validateFile(filePath string) []error {
+	file := viper.New()
+	file.SetConfigFile(filePath)
+	if err := file.ReadInConfig(); err != nil {
+		return []error{err}
+	}
+	return validateSettings(file.AllSettings())
+}
+
+// redactURLs hides the credentials of every URL found in value, such as a
+// proxy or a broker URL carrying user:password@.
+func redactURLs(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		u, err := url.Parse(v)
+		if err != nil || u.User == nil || u.Host == "" {
+			return v
+		}
+		u.User = url.User("redacted")
+		return u.String()
+	case map[string]interface{}:
+		for key, nested := range v {
+			v[key] = redactURLs(nested)
+		}
+	case []interface{}:
+		for idx, nested := range v {
+			v[idx] = redactURLs(nested)
+		}
+	case []string:
+		for idx, nested := range v {
+			v[idx] = redactURLs(nested).(string)
+		}
+	}
+	return value
+}
+
+func redactedSettings(config *viper.Viper) map[string]interface{} {
+	settings := redactURLs(config.AllSettings()).(map[string]interface{})
+	for _, key := range secretSettings {
+		tokens := strings.Split(key, ".")
+		parent := settings
+		for _, token := range tokens[:len(tokens)-1] {
+			nested, ok := parent[token].(map[string]interface{})
+			if !ok {
+				parent = nil
+				break
+			}
+			parent = nested
+		}
+		if parent != nil {
+			if _, ok := parent[tokens[len(tokens)-1]]; ok {
+				parent[tokens[len(tokens)-1]] = "********"
+			}
+		}
+	}
+	return settings
+}
+
+// persistConfig merges fragment into the configuration file. The running
+// configuration is then updated by the file watcher.
+func persistConfig(fragment map[string]interface{}) error {
+	file := viper.New()
+	file.SetConfigFile(configPath())
+	if _, err := os.Stat(configPath()); err == nil {
+		if err := file.ReadInConfig(); err != nil {
+			return fmt.Errorf("failed to read %s: %v", configPath(), err)
+		}
+	}
+	if err := file.MergeConfigMap(fragment); err != nil {
+		return err
+	}
+	return writeConfigFile(file)
+}
+
+// writeConfigFile replaces the configuration file with the settings of file.
+// It is only readable by its owner, as it may hold the MQTT password.
+func writeConfigFile(file *viper.Viper) error {
+	if err := os.MkdirAll(configDir(), 0700); err != nil {
+		return err
+	}
+	// The temporary file is created first, so that it is never readable by
+	// others, even while being written.
+	tmp := path.Join(configDir(), ".config.tmp.yaml")
+	os.Remove(tmp)
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	f.Close()
+	if err := file.WriteConfigAs(tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Chmod(tmp, 0600); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, configPath()); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// loadConfig reads the configuration file. A missing file is fine, a broken
+// one is not.
+func loadConfig(config *viper.Viper, cmd *cobra.Command) error {
+	config.BindEnv()
+	config.BindPFlags(cmd.Flags())
+	config.BindPFlags(cmd.PersistentFlags())
+	err := config.ReadInConfig()
+	setupLogging(config)
+	if _, proxyErr := proxyURL(config); proxyErr != nil {
+		return proxyErr
+	}
+	if _, ok := err.(viper.ConfigFileNotFoundError); ok {
+		log.Warnf("no configuration file found in %s, run \"config init\" to create one", configDir())
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load config: %v", err)
+	}
+	return nil
+}
+
+// applyCompat maps deprecated settings to their current location.
+func applyCompat(config *viper.Viper) {
+	if !config.IsSet("providers.webcam.path") {
+		config.Set("providers.webcam.path", config.GetString("webcam-path"))
+	}
+}
+
+func publishConfig(device homie.Device, config *viper.Viper) {
+	payload, err := json.Marshal(redactedSettings(config))
+	if err != nil {
+		log.Errorf("failed to encode configuration: %v", err)
+		return
+	}
+	device.SendMessage("$implementation/config", string(payload))
+}
+
+// remoteSettings lists the settings which may be changed over MQTT. A
+// trailing dot allows a whole section. Brokers, credentials, TLS and OTA keys
+// are left out: whoever can publish on the config topic must not be able to
+// take over the device.
+var remoteSettings = []string{
+	"log.level",
+	"log.remote-level",
+	"mqtt.notify-interval",
+	"broadcast.groups",
+	"broadcast.tags",
+	"providers.",
+}
+
+func checkRemoteSettings(fragment map[string]interface{}) []error {
+	flat := map[string]interface{}{}
+	flattenSettings("", fragment, flat)
+	keys := make([]string, 0, len(flat))
+	for key := range flat {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	errs := []error{}
+	for _, key := range keys {
+		allowed := false
+		for _, setting := range remoteSettings {
+			if key == setting || (strings.HasSuffix(setting, ".") && strings.HasPrefix(key, setting)) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			errs = append(errs, fmt.Errorf("%s: cannot be changed remotely", key))
+		}
+	}
+	return errs
+}
+
+func joinErrors(errs []error) string {
+	msgs := make([]string, len(errs))
+	for idx, err := range errs {
+		msgs[idx] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// handleRemoteConfig serves the $implementation/config/get and
+// $implementation/config/set topics. saved is called once a fragment was
+// written to the configuration file.
+func handleRemoteConfig(device homie.Device, config *viper.Viper, saved func()) {
+	device.Client().Subscribe(device.Topic("$implementation/config/get"), 1, func(_ mqtt.Client, message mqtt.Message) {
+		if message.Retained() {
+			return
+		}
+		publishConfig(device, config)
+	})
+	device.Client().Subscribe(device.Topic("$implementation/config/set"), 1, func(_ mqtt.Client, message mqtt.Message) {
+		if message.Retained() {
+			return
+		}
+		fragment := map[string]interface{}{}
+		err := json.Unmarshal(message.Payload(), &fragment)
+		if err != nil {
+			err = fmt.Errorf("invalid configuration fragment: %v", err)
+		} else if errs := checkRemoteSettings(fragment); len(errs) > 0 {
+			err = fmt.Errorf("forbidden configuration: %s", joinErrors(errs))
+		} else if errs := validateSettings(fragment); len(errs) > 0 {
+			err = fmt.Errorf("invalid configuration: %s", joinErrors(errs))
+		} else {
+			err = persistConfig(fragment)
+		}
+		if err != nil {
+			log.Warnf("refusing remote configuration: %v", err)
+			device.SendMessage("$implementation/config/error", err.Error())
+			return
+		}
+		log.Infof("remote configuration saved to %s", configPath())
+		device.SendMessage("$implementation/config/error", "")
+		saved()
+	})
+}
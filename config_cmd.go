@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/jbonachera/mqtt-laptop-agent/provider"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func prompt(in *bufio.Reader, out io.Writer, question, defaultValue string) (string, error) {
+	if defaultValue != "" {
+		fmt.Fprintf(out, "%s [%s]: ", question, defaultValue)
+	} else {
+		fmt.Fprintf(out, "%s: ", question)
+	}
+	answer, err := in.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	answer = strings.TrimSpace(answer)
+	if answer == "" {
+		return defaultValue, nil
+	}
+	return answer, nil
+}
+
+func configInitCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "init",
+		Short: "Interactively write a starter configuration file",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			force, _ := cmd.Flags().GetBool("force")
+			if _, err := os.Stat(configPath()); err == nil && !force {
+				return fmt.Errorf("%s already exists, use --force to overwrite it", configPath())
+			}
+			hostname, _ := os.Hostname()
+			questions := []struct {
+				key, question, defaultValue string
+			}{
+				{"homie.name", "Device name", hostname},
+				{"mqtt.broker", "Broker URL", "tcp://localhost:1883"},
+				{"mqtt.username", "MQTT username", ""},
+				{"mqtt.password", "MQTT password", ""},
+				{"providers.webcam.path", "Webcam device", "/dev/video0"},
+			}
+			in := bufio.NewReader(cmd.InOrStdin())
+			out := cmd.OutOrStdout()
+			file := viper.New()
+			for _, q := range questions {
+				answer, err := prompt(in, out, q.question, q.defaultValue)
+				if err != nil {
+					return err
+				}
+				if answer != "" {
+					file.Set(q.key, answer)
+				}
+			}
+			if errs := validateSettings(file.AllSettings()); len(errs) > 0 {
+				return errs[0]
+			}
+			if err := writeConfigFile(file); err != nil {
+				return err
+			}
+			fmt.Fprintf(out, "configuration written to %s\n", configPath())
+			return nil
+		},
+	}
+	cmd.Flags().Bool("force", false, "overwrite an existing configuration file")
+	return cmd
+}
+
+func checkBroker(config *viper.Viper, b broker, timeout time.Duration) error {
+	options, err := mqttBrokerOptions(config, fmt.Sprintf("agent-config-check-%d", os.Getpid()), b)
+	if err != nil {
+		return err
+	}
+	options.SetConnectTimeout(timeout)
+	options.SetAutoReconnect(false)
+	client := mqtt.NewClient(options)
+	token := client.Connect()
+	if !token.WaitTimeout(timeout) {
+		return fmt.Errorf("timed out after %s", timeout)
+	}
+	if token.Error() != nil {
+		return token.Error()
+	}
+	client.Disconnect(250)
+	return nil
+}
+
+func configCheckCommand(config *viper.Viper) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "check",
+		Short: "Validate the configuration, test brokers and list available providers",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			out := cmd.OutOrStdout()
+			failed := false
+			file := config.ConfigFileUsed()
+			if file == "" {
+				file = configPath()
+			}
+			fmt.Fprintf(out, "configuration file %s\n", file)
+			errs := validateFile(file)
+			for _, err := range errs {
+				fmt.Fprintf(out, "  invalid: %v\n", err)
+			}
+			if len(errs) > 0 {
+				failed = true
+			} else {
+				fmt.Fprintf(out, "  ok\n")
+			}
+
+			timeout, _ := cmd.Flags().GetDuration("timeout")
+			fmt.Fprintf(out, "brokers\n")
+			brokers := configuredBrokers(config)
+			if len(brokers) == 0 {
+				fmt.Fprintf(out, "  none configured\n")
+				failed = true
+			}
+			for _, b := range brokers {
+				if err := checkBroker(config, b, timeout); err != nil {
+					fmt.Fprintf(out, "  %s: unreachable: %v\n", b.URL, err)
+					failed = true
+					continue
+				}
+				fmt.Fprintf(out, "  %s: ok\n", b.URL)
+			}
+
+			applyCompat(config)
+			fmt.Fprintf(out, "providers\n")
+			availabilities := provider.Probe(config)
+			sort.Slice(availabilities, func(i, j int) bool {
+				return availabilities[i].Name < availabilities[j].Name
+			})
+			for _, a := range availabilities {
+				switch {
+				case !a.Enabled:
+					fmt.Fprintf(out, "  %s: disabled\n", a.Name)
+				case a.Err != nil:
+					fmt.Fprintf(out, "  %s: invalid configuration: %v\n", a.Name, a.Err)
+					failed = true
+				case !a.Available:
+					fmt.Fprintf(out, "  %s: not available on this machine\n", a.Name)
+				default:
+					fmt.Fprintf(out, "  %s: available\n", a.Name)
+				}
+			}
+			if failed {
+				return fmt.Errorf("configuration check failed")
+			}
+			return nil
+		},
+	}
+	cmd.Flags().Duration("timeout", 5*time.Second, "how long to wait for each broker")
+	return cmd
+}
+
+func configCommand(config *viper.Viper) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "config",
+		Short: "Write and validate the agent configuration",
+		Long:  "Write and validate the agent configuration.\n\nSettings:\n" + describeConfig(),
+		// A broken configuration file must not prevent fixing or checking
+		// it.
+		PersistentPreRun: func(cmd *cobra.Command, _ []string) {
+			if err := loadConfig(config, cmd); err != nil {
+				log.Warnf("%v", err)
+			}
+		},
+	}
+	cmd.AddCommand(configInitCommand())
+	cmd.AddCommand(configCheckCommand(config))
+	return cmd
+}
+
+// describeConfig lists every setting with its description.
+func describeConfig() string {
+	keys := make([]string, 0, len(configSchema))
+	for key := range configSchema {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	b := &strings.Builder{}
+	for _, key := range keys {
+		fmt.Fprintf(b, "  %-24s %s\n", key, configSchema[key].description)
+	}
+	fmt.Fprintf(b, "  %-24s %s\n", "providers.<name>.enabled", "set to false to disable a provider")
+	return b.String()
+}
@@ -2,18 +2,23 @@ package dafang
 
 import (
 	"bytes"
-	"log"
+	"context"
 	"os"
 	"os/exec"
 	"time"
 
 	homie "github.com/jbonachera/homie-go/homie"
+	"github.com/jbonachera/mqtt-laptop-agent/metrics"
+	"github.com/jbonachera/mqtt-laptop-agent/property"
 )
 
+var captureDuration = metrics.NewHistogram("agent_dafang_capture_seconds", "Time taken to capture a camera frame.", metrics.DefaultBuckets)
+
 func capture() ([]byte, error) {
+	defer captureDuration.Since(time.Now())
 	for {
 		if _, err := os.Stat("/system/sdcard/bin/getimage"); err != nil {
-			log.Println(err)
+			log.Errorf("%v", err)
 			return nil, err
 		}
 		cmd := exec.Command("/system/sdcard/bin/getimage")
@@ -35,20 +40,23 @@ type webcamProvider struct {
 	path string
 }
 
-func cameraProperty(arm, disarm chan struct{}, externalTrigger chan struct{}, node homie.Node) {
+func cameraProperty(ctx context.Context, arm, disarm chan struct{}, externalTrigger chan struct{}, node homie.Node) {
 	v, err := capture()
 	if err != nil {
-		log.Print(err)
+		log.Errorf("%v", err)
 		return
 	}
 	trigger := make(chan struct{}, 1)
-	frame := node.NewProperty("frame", "jpeg")
+	frame := property.New("frame", property.String).Format("image/jpeg").Persistent(false).Build(node)
 	frame.SetValue(string(v))
 	go func() {
 		disabled := false
 		ticker := time.NewTicker(2 * time.Hour)
+		defer ticker.Stop()
 		for {
 			select {
+			case <-ctx.Done():
+				return
 			case <-arm:
 				disabled = false
 			case <-disarm:
@@ -60,7 +68,7 @@ func cameraProperty(arm, disarm chan struct{}, externalTrigger chan struct{}, no
 			if !disabled && node.Device() != nil && node.Device().Client() != nil && node.Device().Client().IsConnected() {
 				v, err := capture()
 				if err != nil {
-					log.Print(err)
+					log.Errorf("%v", err)
 				}
 				frame.SetValue(string(v)).Publish()
 			}
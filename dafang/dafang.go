@@ -1,13 +1,28 @@
 package dafang
 
 import (
+	"context"
 	"io"
 	"os"
 	"sync"
 
 	homie "github.com/jbonachera/homie-go/homie"
+	"github.com/jbonachera/mqtt-laptop-agent/logging"
+	"github.com/jbonachera/mqtt-laptop-agent/provider"
 )
 
+var log = logging.New("dafang")
+
+func init() {
+	provider.Register(provider.Definition{
+		Name:     "dafang",
+		NodeType: "dafang",
+		New: func() provider.Provider {
+			return NewProvider()
+		},
+	})
+}
+
 type dafangProvider struct {
 	armCh          chan struct{}
 	disarmCh       chan struct{}
@@ -25,10 +40,14 @@ func NewProvider() *dafangProvider {
 		cameraDisarmCh: make(chan struct{}, 1),
 	}
 }
-func (l *dafangProvider) Stop() {
+func (l *dafangProvider) Stop() error {
 	if l.motorCloser != nil {
-		l.motorCloser.Close()
+		return l.motorCloser.Close()
 	}
+	return nil
+}
+func (l *dafangProvider) BroadcastLevels() []string {
+	return []string{"alarm"}
 }
 func (l *dafangProvider) Broadcast(level string, payload []byte) {
 	l.mtx.Lock()
@@ -63,9 +82,10 @@ func (l *dafangProvider) Available() bool {
 	}
 	return true
 }
-func (l *dafangProvider) Serve(node homie.Node) {
+func (l *dafangProvider) Start(ctx context.Context, node homie.Node) error {
 	trigger := make(chan struct{}, 1)
-	daylightProperty(node)
-	cameraProperty(l.cameraArmCh, l.cameraDisarmCh, trigger, node)
-	l.motorCloser = motorProperty(l.armCh, l.disarmCh, trigger, node)
+	daylightProperty(ctx, node)
+	cameraProperty(ctx, l.cameraArmCh, l.cameraDisarmCh, trigger, node)
+	l.motorCloser = motorProperty(ctx, l.armCh, l.disarmCh, trigger, node)
+	return nil
 }
@@ -1,14 +1,15 @@
 package dafang
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"log"
 	"os"
 	"time"
 
 	"github.com/jbonachera/homie-go/homie"
+	"github.com/jbonachera/mqtt-laptop-agent/property"
 )
 
 const (
@@ -34,30 +35,34 @@ func toPercent(value uint16) int {
 	return int(value) * 100 / 3057
 }
 
-func daylightProperty(node homie.Node) {
+func daylightProperty(ctx context.Context, node homie.Node) {
 	v, err := readDaylight()
 	if err != nil {
-		log.Printf("failed to read dafang daylight: %v", err)
+		log.Errorf("failed to read dafang daylight: %v", err)
 		return
 	}
-	daylightPercent := node.NewProperty("daylightPercent", "number")
-	daylight := node.NewProperty("daylight", "number")
+	daylightPercent := property.New("daylightPercent", property.Integer).Unit("%").Build(node)
+	daylight := property.New("daylight", property.Integer).Build(node)
 	daylight.SetValue(fmt.Sprintf("%d", v))
 	daylightPercent.SetValue(fmt.Sprintf("%d", toPercent(v)))
 
 	go func() {
 		ticker := time.NewTicker(30 * time.Second)
-		for range ticker.C {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
 			v, err := readDaylight()
 			if err != nil {
-				log.Printf("failed to read dafang daylight: %v", err)
+				log.Errorf("failed to read dafang daylight: %v", err)
 			} else {
 				daylight.SetValue(fmt.Sprintf("%d", v))
 				daylightPercent.SetValue(fmt.Sprintf("%d", toPercent(v)))
-				if node.Device().Client().IsConnected() {
-					daylight.Publish()
-					daylightPercent.Publish()
-				}
+				daylight.Publish()
+				daylightPercent.Publish()
 			}
 		}
 	}()
@@ -1,10 +1,10 @@
 package dafang
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"os"
 	"strconv"
 	"sync"
@@ -12,6 +12,8 @@ import (
 	"unsafe"
 
 	homie "github.com/jbonachera/homie-go/homie"
+	"github.com/jbonachera/mqtt-laptop-agent/metrics"
+	"github.com/jbonachera/mqtt-laptop-agent/property"
 	"golang.org/x/sys/unix"
 )
 
@@ -50,6 +52,22 @@ const (
 	RightDirection
 )
 
+func (d Direction) String() string {
+	switch d {
+	case UpDirection:
+		return "up"
+	case DownDirection:
+		return "down"
+	case LeftDirection:
+		return "left"
+	case RightDirection:
+		return "right"
+	}
+	return "unknown"
+}
+
+var motorMoves = metrics.NewCounterVec("agent_dafang_motor_moves_total", "Motor movements, by direction.", "direction")
+
 const (
 	HorizontalAxis Axis = 1 + iota
 	VerticalAxis
@@ -76,30 +94,30 @@ type ResetData struct {
 	y_cur_step  uint
 }
 
-func motorProperty(arm, disarm chan struct{}, screenshotTrigger chan struct{}, node homie.Node) io.Closer {
+func motorProperty(ctx context.Context, arm, disarm chan struct{}, screenshotTrigger chan struct{}, node homie.Node) io.Closer {
 	controller, err := NewController()
 	if err != nil {
-		log.Printf("failed to start dafang motor: %v", err)
+		log.Errorf("failed to start dafang motor: %v", err)
 		return nil
 	}
 	err = controller.Calibrate()
 	if err != nil {
-		log.Printf("failed to calibrate dafang motor: %v", err)
+		log.Errorf("failed to calibrate dafang motor: %v", err)
 		return nil
 	}
 	status, err := controller.Status()
 	if err != nil {
-		log.Printf("failed to read dafang motor status: %v", err)
+		log.Errorf("failed to read dafang motor status: %v", err)
 		return nil
 	}
-	xAxis := node.NewProperty("x_axis", "number").SetValue(fmt.Sprintf("%d", status.X))
-	yAxis := node.NewProperty("y_axis", "number").SetValue(fmt.Sprintf("%d", status.Y))
-	xAxisIncr := node.NewProperty("x_axis_incr", "number").SetValue(fmt.Sprintf("%d", status.X))
-	yAxisIncr := node.NewProperty("y_axis_incr", "number").SetValue(fmt.Sprintf("%d", status.Y))
-	node.NewProperty("x_axis_max", "number").SetValue(fmt.Sprintf("%d", xMax))
-	node.NewProperty("y_axis_max", "number").SetValue(fmt.Sprintf("%d", yMax))
-	node.NewProperty("x_axis_min", "number").SetValue(fmt.Sprintf("%d", xMin))
-	node.NewProperty("y_axis_min", "number").SetValue(fmt.Sprintf("%d", yMin))
+	xAxis := property.New("x_axis", property.Integer).Range(xMin, xMax).Build(node).SetValue(fmt.Sprintf("%d", status.X))
+	yAxis := property.New("y_axis", property.Integer).Range(yMin, yMax).Build(node).SetValue(fmt.Sprintf("%d", status.Y))
+	xAxisIncr := property.New("x_axis_incr", property.Integer).Range(-xMax, xMax).Retained(false).Build(node).SetValue(fmt.Sprintf("%d", status.X))
+	yAxisIncr := property.New("y_axis_incr", property.Integer).Range(-yMax, yMax).Retained(false).Build(node).SetValue(fmt.Sprintf("%d", status.Y))
+	property.New("x_axis_max", property.Integer).Build(node).SetValue(fmt.Sprintf("%d", xMax))
+	property.New("y_axis_max", property.Integer).Build(node).SetValue(fmt.Sprintf("%d", yMax))
+	property.New("x_axis_min", property.Integer).Build(node).SetValue(fmt.Sprintf("%d", xMin))
+	property.New("y_axis_min", property.Integer).Build(node).SetValue(fmt.Sprintf("%d", yMin))
 
 	xAxis.SetHandler(func(p homie.Property, payload []byte, topic string) (bool, error) {
 		parsed, err := strconv.ParseInt(string(payload), 10, 32)
@@ -109,12 +127,12 @@ func motorProperty(arm, disarm chan struct{}, screenshotTrigger chan struct{}, n
 		step := int(parsed)
 		err = controller.SetX(step)
 		if err != nil {
-			log.Printf("failed to move dafang motor: %v", err)
+			log.Errorf("failed to move dafang motor: %v", err)
 			return false, err
 		}
 		status, err := controller.Status()
 		if err != nil {
-			log.Printf("failed to read dafang motor status: %v", err)
+			log.Errorf("failed to read dafang motor status: %v", err)
 			return false, err
 		}
 		xAxis.SetValue(fmt.Sprintf("%d", status.X)).Publish()
@@ -134,12 +152,12 @@ func motorProperty(arm, disarm chan struct{}, screenshotTrigger chan struct{}, n
 		step := int(parsed)
 		err = controller.IncrX(step)
 		if err != nil {
-			log.Printf("failed to move dafang motor: %v", err)
+			log.Errorf("failed to move dafang motor: %v", err)
 			return false, err
 		}
 		status, err := controller.Status()
 		if err != nil {
-			log.Printf("failed to read dafang motor status: %v", err)
+			log.Errorf("failed to read dafang motor status: %v", err)
 			return false, err
 		}
 		xAxis.SetValue(fmt.Sprintf("%d", status.X)).Publish()
@@ -159,12 +177,12 @@ func motorProperty(arm, disarm chan struct{}, screenshotTrigger chan struct{}, n
 		step := int(parsed)
 		err = controller.SetY(step)
 		if err != nil {
-			log.Printf("failed to move dafang motor: %v", err)
+			log.Errorf("failed to move dafang motor: %v", err)
 			return false, err
 		}
 		status, err := controller.Status()
 		if err != nil {
-			log.Printf("failed to read dafang motor status: %v", err)
+			log.Errorf("failed to read dafang motor status: %v", err)
 			return false, err
 		}
 		yAxis.SetValue(fmt.Sprintf("%d", status.Y)).Publish()
@@ -182,12 +200,12 @@ func motorProperty(arm, disarm chan struct{}, screenshotTrigger chan struct{}, n
 		step := int(parsed)
 		err = controller.IncrY(step)
 		if err != nil {
-			log.Printf("failed to move dafang motor: %v", err)
+			log.Errorf("failed to move dafang motor: %v", err)
 			return false, err
 		}
 		status, err := controller.Status()
 		if err != nil {
-			log.Printf("failed to read dafang motor status: %v", err)
+			log.Errorf("failed to read dafang motor status: %v", err)
 			return false, err
 		}
 		yAxis.SetValue(fmt.Sprintf("%d", status.Y)).Publish()
@@ -201,6 +219,8 @@ func motorProperty(arm, disarm chan struct{}, screenshotTrigger chan struct{}, n
 	go func() {
 		for {
 			select {
+			case <-ctx.Done():
+				return
 			case <-disarm:
 				controller.goTo(0, 0)
 				controller.disabled = true
@@ -214,7 +234,7 @@ func motorProperty(arm, disarm chan struct{}, screenshotTrigger chan struct{}, n
 			}
 		}
 	}()
-	log.Printf("dafang motor initialized")
+	log.Infof("dafang motor initialized")
 	return controller
 }
 
@@ -227,7 +247,12 @@ func NewController() (*Controller, error) {
 
 	return c, c.Speed(1200)
 }
+
+// Close stops any ongoing movement and releases the motor device.
 func (controller *Controller) Close() error {
+	if err := controller.Stop(); err != nil {
+		log.Errorf("failed to stop dafang motor: %v", err)
+	}
 	return unix.Close(controller.fd)
 }
 func (controller *Controller) move(direction Direction, steps int) error {
@@ -252,6 +277,7 @@ func (controller *Controller) move(direction Direction, steps int) error {
 	if err != nil {
 		return err
 	}
+	motorMoves.Inc(direction.String())
 	return controller.wait()
 }
 func (controller *Controller) goTo(x, y int) error {
@@ -291,21 +317,21 @@ func (controller *Controller) Reset() error {
 	return controller.sendCommand(ResetCommand, unsafe.Pointer(reset))
 }
 func (controller *Controller) up(steps int) error {
-	log.Printf("motor: %d steps up", steps)
+	log.Debugf("motor: %d steps up", steps)
 	return controller.move(UpDirection, steps)
 }
 
 func (controller *Controller) down(steps int) error {
-	log.Printf("motor: %d steps down", steps)
+	log.Debugf("motor: %d steps down", steps)
 	return controller.move(DownDirection, steps)
 }
 
 func (controller *Controller) right(steps int) error {
-	log.Printf("motor: %d steps right", steps)
+	log.Debugf("motor: %d steps right", steps)
 	return controller.move(RightDirection, steps)
 }
 func (controller *Controller) left(steps int) error {
-	log.Printf("motor: %d steps left", steps)
+	log.Debugf("motor: %d steps left", steps)
 	return controller.move(LeftDirection, steps)
 }
 
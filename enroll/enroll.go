@@ -0,0 +1,267 @@
+package enroll
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/jbonachera/mqtt-laptop-agent/logging"
+)
+
+var log = logging.New("enroll")
+
+var (
+	errTimeout        = errors.New("timed out waiting for the signed certificate")
+	errKeyMismatch    = errors.New("signed certificate does not match our private key")
+	errUntrustedChain = errors.New("signed certificate does not chain to the trusted CA")
+)
+
+// Client is the part of the MQTT client used to enroll.
+type Client interface {
+	Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token
+	Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token
+	Unsubscribe(topics ...string) mqtt.Token
+}
+
+// Paths tells where the enrolled key, certificate and CA chain are stored.
+type Paths struct {
+	Key         string
+	Certificate string
+	CA          string
+}
+
+// Request is published on <topic><name>/csr.
+type Request struct {
+	CSR string `json:"csr"`
+}
+
+// Response is expected on <topic><name>/certificate.
+type Response struct {
+	Certificate string `json:"certificate"`
+	CA          string `json:"ca"`
+	Error       string `json:"error,omitempty"`
+}
+
+func newRequest(name string) (*ecdsa.PrivateKey, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate private key: %v", err)
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: name},
+	}, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create certificate request: %v", err)
+	}
+	return key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr}), nil
+}
+
+func parseCertificates(bundle []byte) []*x509.Certificate {
+	certs := []*x509.Certificate{}
+	for {
+		var block *pem.Block
+		block, bundle = pem.Decode(bundle)
+		if block == nil {
+			return certs
+		}
+		if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+			certs = append(certs, cert)
+		}
+	}
+}
+
+// checkResponse makes sure the signed certificate matches the key and the
+// name we asked for, and chains to trusted. The CA of the response is only
+// trusted when trusted is nil, on the first enrollment.
+func checkResponse(name string, key *ecdsa.PrivateKey, response Response, trusted []*x509.Certificate) (*x509.Certificate, error) {
+	if response.Error != "" {
+		return nil, fmt.Errorf("enrollment refused: %s", response.Error)
+	}
+	block, _ := pem.Decode([]byte(response.Certificate))
+	if block == nil {
+		return nil, errors.New("no certificate found in enrollment response")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signed certificate: %v", err)
+	}
+	public, ok := cert.PublicKey.(*ecdsa.PublicKey)
+	if !ok || public.X.Cmp(key.X) != 0 || public.Y.Cmp(key.Y) != 0 {
+		return nil, errKeyMismatch
+	}
+	if cert.Subject.CommonName != name {
+		return nil, fmt.Errorf("signed certificate was issued to %q", cert.Subject.CommonName)
+	}
+	if trusted == nil {
+		trusted = parseCertificates([]byte(response.CA))
+		if len(trusted) == 0 {
+			return nil, errors.New("no CA certificate found in enrollment response")
+		}
+	}
+	roots := x509.NewCertPool()
+	for _, ca := range trusted {
+		roots.AddCert(ca)
+	}
+	_, err = cert.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errUntrustedChain, err)
+	}
+	return cert, nil
+}
+
+type file struct {
+	path    string
+	content []byte
+	mode    os.FileMode
+}
+
+// writeFiles writes every file to a temporary path before renaming any of
+// them, so that a failure does not leave a key without its certificate.
+func writeFiles(files ...file) error {
+	for _, f := range files {
+		err := os.MkdirAll(filepath.Dir(f.path), 0700)
+		if err == nil {
+			err = ioutil.WriteFile(f.path+".tmp", f.content, f.mode)
+		}
+		if err != nil {
+			for _, f := range files {
+				os.Remove(f.path + ".tmp")
+			}
+			return fmt.Errorf("failed to write %s: %v", f.path, err)
+		}
+	}
+	for _, f := range files {
+		if err := os.Rename(f.path+".tmp", f.path); err != nil {
+			return fmt.Errorf("failed to write %s: %v", f.path, err)
+		}
+	}
+	return nil
+}
+
+// Enroll generates a new private key, asks the enrollment service listening
+// on topic to sign it, and stores the result in paths. Once a CA is stored,
+// it is kept: renewed certificates must chain to it.
+func Enroll(client Client, topic, name string, paths Paths, timeout time.Duration) (*x509.Certificate, error) {
+	var trusted []*x509.Certificate
+	if buf, err := ioutil.ReadFile(paths.CA); err == nil {
+		trusted = parseCertificates(buf)
+		if len(trusted) == 0 {
+			return nil, fmt.Errorf("no CA certificate found in %s", paths.CA)
+		}
+	}
+	key, csr, err := newRequest(name)
+	if err != nil {
+		return nil, err
+	}
+	responses := make(chan Response, 1)
+	responseTopic := fmt.Sprintf("%s%s/certificate", topic, name)
+	token := client.Subscribe(responseTopic, 1, func(_ mqtt.Client, message mqtt.Message) {
+		if message.Retained() {
+			return
+		}
+		response := Response{}
+		if err := json.Unmarshal(message.Payload(), &response); err != nil {
+			log.Warnf("ignoring invalid enrollment response: %v", err)
+			return
+		}
+		select {
+		case responses <- response:
+		default:
+		}
+	})
+	if token.Wait() && token.Error() != nil {
+		return nil, token.Error()
+	}
+	defer client.Unsubscribe(responseTopic)
+
+	payload, err := json.Marshal(Request{CSR: string(csr)})
+	if err != nil {
+		return nil, err
+	}
+	token = client.Publish(fmt.Sprintf("%s%s/csr", topic, name), 1, false, payload)
+	if token.Wait() && token.Error() != nil {
+		return nil, token.Error()
+	}
+
+	var response Response
+	select {
+	case response = <-responses:
+	case <-time.After(timeout):
+		return nil, errTimeout
+	}
+	cert, err := checkResponse(name, key, response, trusted)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	files := []file{
+		{paths.Key, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600},
+		{paths.Certificate, []byte(response.Certificate), 0644},
+	}
+	if trusted == nil {
+		files = append(files, file{paths.CA, []byte(response.CA), 0644})
+	}
+	if err := writeFiles(files...); err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+// renewalDue tells whether less than a third of the certificate lifetime
+// remains.
+func renewalDue(cert *x509.Certificate, now time.Time) bool {
+	lifetime := cert.NotAfter.Sub(cert.NotBefore)
+	return now.After(cert.NotAfter.Add(-lifetime / 3))
+}
+
+func loadCertificate(path string) (*x509.Certificate, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(buf)
+	if block == nil {
+		return nil, fmt.Errorf("no certificate found in %s", path)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// RenewLoop periodically checks the stored certificate and renews it through
+// client before it expires, until ctx is done.
+func RenewLoop(ctx context.Context, client func() mqtt.Client, topic, name string, paths Paths, interval time.Duration) {
+	next := time.Minute
+	for {
+		select {
+		case <-time.After(next):
+		case <-ctx.Done():
+			return
+		}
+		next = interval
+		cert, err := loadCertificate(paths.Certificate)
+		if err == nil && renewalDue(cert, time.Now()) {
+			c := client()
+			if c != nil && c.IsConnected() {
+				log.Infof("certificate expires on %s, renewing it", cert.NotAfter.Format(time.RFC3339))
+				_, err = Enroll(c, topic, name, paths, time.Minute)
+				if err != nil {
+					log.Errorf("failed to renew certificate: %v", err)
+				}
+			}
+		}
+	}
+}
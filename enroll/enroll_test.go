@@ -0,0 +1,231 @@
+package enroll
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+type token struct {
+	mqtt.Token
+}
+
+func (token) Wait() bool   { return true }
+func (token) Error() error { return nil }
+
+type message struct {
+	mqtt.Message
+	topic   string
+	payload []byte
+}
+
+func (m message) Topic() string   { return m.topic }
+func (m message) Payload() []byte { return m.payload }
+func (m message) Retained() bool  { return false }
+
+// fakeBroker routes the certificate requests of Enroll to an in-process
+// signer.
+type fakeBroker struct {
+	mtx      sync.Mutex
+	handlers map[string]mqtt.MessageHandler
+	sign     func(csr *x509.CertificateRequest) *Response
+}
+
+func (b *fakeBroker) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.handlers[topic] = callback
+	return token{}
+}
+
+func (b *fakeBroker) Unsubscribe(topics ...string) mqtt.Token {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	for _, topic := range topics {
+		delete(b.handlers, topic)
+	}
+	return token{}
+}
+
+func (b *fakeBroker) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	request := Request{}
+	if err := json.Unmarshal(payload.([]byte), &request); err != nil {
+		panic(err)
+	}
+	block, _ := pem.Decode([]byte(request.CSR))
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		panic(err)
+	}
+	response := b.sign(csr)
+	if response == nil {
+		return token{}
+	}
+	encoded, _ := json.Marshal(response)
+	responseTopic := strings.TrimSuffix(topic, "/csr") + "/certificate"
+	b.mtx.Lock()
+	handler := b.handlers[responseTopic]
+	b.mtx.Unlock()
+	go handler(nil, message{topic: responseTopic, payload: encoded})
+	return token{}
+}
+
+type authority struct {
+	key  *ecdsa.PrivateKey
+	cert *x509.Certificate
+	pem  string
+}
+
+func newAuthority(t *testing.T) *authority {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &authority{key: key, cert: cert, pem: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))}
+}
+
+func (a *authority) sign(t *testing.T, name string, public interface{}) string {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, a.cert, public, a.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+func testPaths(t *testing.T) Paths {
+	dir, err := ioutil.TempDir("", "enroll")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return Paths{
+		Key:         filepath.Join(dir, "client.key"),
+		Certificate: filepath.Join(dir, "client.crt"),
+		CA:          filepath.Join(dir, "ca.crt"),
+	}
+}
+
+func TestEnroll(t *testing.T) {
+	ca := newAuthority(t)
+	broker := &fakeBroker{handlers: map[string]mqtt.MessageHandler{}}
+	broker.sign = func(csr *x509.CertificateRequest) *Response {
+		return &Response{Certificate: ca.sign(t, csr.Subject.CommonName, csr.PublicKey), CA: ca.pem}
+	}
+	paths := testPaths(t)
+	cert, err := Enroll(broker, "enrollment/", "laptop", paths, time.Second)
+	if err != nil {
+		t.Fatalf("enrollment failed: %v", err)
+	}
+	if cert.Subject.CommonName != "laptop" {
+		t.Errorf("certificate issued to %q", cert.Subject.CommonName)
+	}
+	for _, path := range []string{paths.Key, paths.Certificate, paths.CA} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("%s was not written: %v", path, err)
+		}
+	}
+
+	// Renewals keep the stored CA.
+	if _, err := Enroll(broker, "enrollment/", "laptop", paths, time.Second); err != nil {
+		t.Fatalf("renewal failed: %v", err)
+	}
+}
+
+func TestEnrollKeyMismatch(t *testing.T) {
+	ca := newAuthority(t)
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker := &fakeBroker{handlers: map[string]mqtt.MessageHandler{}}
+	broker.sign = func(csr *x509.CertificateRequest) *Response {
+		return &Response{Certificate: ca.sign(t, csr.Subject.CommonName, &other.PublicKey), CA: ca.pem}
+	}
+	paths := testPaths(t)
+	_, err = Enroll(broker, "enrollment/", "laptop", paths, time.Second)
+	if !errors.Is(err, errKeyMismatch) {
+		t.Fatalf("expected a key mismatch, got %v", err)
+	}
+	if _, err := os.Stat(paths.Key); !os.IsNotExist(err) {
+		t.Errorf("private key was written despite the mismatch")
+	}
+}
+
+func TestEnrollUntrustedChain(t *testing.T) {
+	ca, impostor := newAuthority(t), newAuthority(t)
+	broker := &fakeBroker{handlers: map[string]mqtt.MessageHandler{}}
+	broker.sign = func(csr *x509.CertificateRequest) *Response {
+		return &Response{Certificate: impostor.sign(t, csr.Subject.CommonName, csr.PublicKey), CA: ca.pem}
+	}
+	_, err := Enroll(broker, "enrollment/", "laptop", testPaths(t), time.Second)
+	if !errors.Is(err, errUntrustedChain) {
+		t.Fatalf("expected an untrusted chain, got %v", err)
+	}
+
+	// A renewal answered with another CA must not replace the stored one.
+	paths := testPaths(t)
+	if err := ioutil.WriteFile(paths.CA, []byte(ca.pem), 0644); err != nil {
+		t.Fatal(err)
+	}
+	broker.sign = func(csr *x509.CertificateRequest) *Response {
+		return &Response{Certificate: impostor.sign(t, csr.Subject.CommonName, csr.PublicKey), CA: impostor.pem}
+	}
+	_, err = Enroll(broker, "enrollment/", "laptop", paths, time.Second)
+	if !errors.Is(err, errUntrustedChain) {
+		t.Fatalf("expected an untrusted chain on renewal, got %v", err)
+	}
+	stored, _ := ioutil.ReadFile(paths.CA)
+	if string(stored) != ca.pem {
+		t.Errorf("stored CA was replaced")
+	}
+}
+
+func TestEnrollTimeout(t *testing.T) {
+	broker := &fakeBroker{handlers: map[string]mqtt.MessageHandler{}}
+	broker.sign = func(*x509.CertificateRequest) *Response {
+		return nil
+	}
+	_, err := Enroll(broker, "enrollment/", "laptop", testPaths(t), 50*time.Millisecond)
+	if err != errTimeout {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/jbonachera/mqtt-laptop-agent/enroll"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func enrollPaths() enroll.Paths {
+	return enroll.Paths{
+		Key:         privkeyPath(),
+		Certificate: certPath(),
+		CA:          caPath(),
+	}
+}
+
+func enrollCommand(config *viper.Viper) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "enroll",
+		Short: "Request a client certificate for this device",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			name := config.GetString("homie.name")
+			if name == "" {
+				return fmt.Errorf("homie.name is not configured")
+			}
+			options, err := mqttClientOptions(config, fmt.Sprintf("agent-enroll-%d", os.Getpid()))
+			if err != nil {
+				return err
+			}
+			client := mqtt.NewClient(options)
+			token := client.Connect()
+			if token.Wait() && token.Error() != nil {
+				return fmt.Errorf("failed to connect to MQTT: %v", token.Error())
+			}
+			defer client.Disconnect(250)
+			timeout, _ := cmd.Flags().GetDuration("timeout")
+			fmt.Printf("requesting a certificate for %s\n", name)
+			cert, err := enroll.Enroll(client, config.GetString("enroll.topic"), name, enrollPaths(), timeout)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("certificate stored in %s, valid until %s\n", certPath(), cert.NotAfter.Format(time.RFC3339))
+			return nil
+		},
+	}
+	cmd.Flags().Duration("timeout", 5*time.Minute, "how long to wait for the signed certificate")
+	return cmd
+}
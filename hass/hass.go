@@ -0,0 +1,270 @@
+package hass
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"sync"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/jbonachera/mqtt-laptop-agent/logging"
+)
+
+var log = logging.New("hass")
+
+const DefaultPrefix = "homeassistant"
+
+// entity describes how a homie property shows up in Home Assistant. An empty
+// component hides the property.
+type entity struct {
+	component    string
+	deviceClass  string
+	unit         string
+	stateClass   string
+	icon         string
+	payloadPress string
+	min, max     *float64
+}
+
+func limit(v float64) *float64 {
+	return &v
+}
+
+// entities holds the known properties of the bundled providers, by
+// <node>/<property>. Other properties are mapped from their datatype.
+var entities = map[string]entity{
+	"logind/lock":              {component: "switch", icon: "mdi:lock"},
+	"logind/suspend":           {component: "button", icon: "mdi:power-sleep", payloadPress: "true"},
+	"logind/poweroff":          {component: "button", icon: "mdi:power", payloadPress: "true"},
+	"upower/batteryPercentage": {component: "sensor", deviceClass: "battery", unit: "%", stateClass: "measurement"},
+	"webcam/frame":             {component: "camera"},
+	"dafang/frame":             {component: "camera"},
+	"dafang/daylight":          {component: "sensor", icon: "mdi:brightness-5", stateClass: "measurement"},
+	"dafang/daylightPercent":   {component: "sensor", icon: "mdi:brightness-5", unit: "%", stateClass: "measurement"},
+	"dafang/x_axis":            {component: "number", icon: "mdi:pan-horizontal", min: limit(0), max: limit(1250)},
+	"dafang/y_axis":            {component: "number", icon: "mdi:pan-vertical", min: limit(0), max: limit(400)},
+	"dafang/x_axis_incr":       {component: "number", icon: "mdi:pan-horizontal", min: limit(-1250), max: limit(1250)},
+	"dafang/y_axis_incr":       {component: "number", icon: "mdi:pan-vertical", min: limit(-400), max: limit(400)},
+	"dafang/x_axis_max":        {},
+	"dafang/y_axis_max":        {},
+	"dafang/x_axis_min":        {},
+	"dafang/y_axis_min":        {},
+	"notifications/message":    {component: "text", icon: "mdi:message-text"},
+}
+
+func defaultEntity(datatype string, settable bool) entity {
+	switch datatype {
+	case "bool", "boolean":
+		if settable {
+			return entity{component: "switch"}
+		}
+		return entity{component: "binary_sensor"}
+	case "number", "integer", "float", "float64", "int":
+		if settable {
+			return entity{component: "number"}
+		}
+		return entity{component: "sensor", stateClass: "measurement"}
+	}
+	if settable {
+		return entity{component: "text"}
+	}
+	return entity{component: "sensor"}
+}
+
+type property struct {
+	node     string
+	id       string
+	datatype string
+	settable bool
+}
+
+func (p *property) key() string {
+	return p.node + "/" + p.id
+}
+
+type availability struct {
+	Topic               string `json:"topic"`
+	ValueTemplate       string `json:"value_template"`
+	PayloadAvailable    string `json:"payload_available"`
+	PayloadNotAvailable string `json:"payload_not_available"`
+}
+
+type deviceInfo struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+	Model        string   `json:"model"`
+	SWVersion    string   `json:"sw_version"`
+}
+
+type config struct {
+	Name              string         `json:"name"`
+	UniqueID          string         `json:"unique_id"`
+	ObjectID          string         `json:"object_id"`
+	StateTopic        string         `json:"state_topic,omitempty"`
+	Topic             string         `json:"topic,omitempty"`
+	CommandTopic      string         `json:"command_topic,omitempty"`
+	PayloadOn         string         `json:"payload_on,omitempty"`
+	PayloadOff        string         `json:"payload_off,omitempty"`
+	StateOn           string         `json:"state_on,omitempty"`
+	StateOff          string         `json:"state_off,omitempty"`
+	PayloadPress      string         `json:"payload_press,omitempty"`
+	DeviceClass       string         `json:"device_class,omitempty"`
+	UnitOfMeasurement string         `json:"unit_of_measurement,omitempty"`
+	StateClass        string         `json:"state_class,omitempty"`
+	Icon              string         `json:"icon,omitempty"`
+	Min               *float64       `json:"min,omitempty"`
+	Max               *float64       `json:"max,omitempty"`
+	Availability      []availability `json:"availability"`
+	Device            deviceInfo     `json:"device"`
+}
+
+var unsafeChars = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+func objectID(parts ...string) string {
+	id := ""
+	for idx, part := range parts {
+		if idx > 0 {
+			id += "_"
+		}
+		id += unsafeChars.ReplaceAllString(part, "_")
+	}
+	return id
+}
+
+// Discovery publishes Home Assistant discovery configs for the registered
+// homie properties.
+type Discovery struct {
+	mtx        sync.Mutex
+	prefix     string
+	name       string
+	version    string
+	topic      func(path string) string
+	client     mqtt.Client
+	properties map[string]*property
+}
+
+// New returns a Discovery for the device called name, whose topics are
+// returned by topic.
+func New(prefix, name, version string, topic func(path string) string) *Discovery {
+	if prefix == "" {
+		prefix = DefaultPrefix
+	}
+	return &Discovery{
+		prefix:     prefix,
+		name:       name,
+		version:    version,
+		topic:      topic,
+		properties: map[string]*property{},
+	}
+}
+
+func (d *Discovery) register(node, id, datatype string) *property {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	p := &property{node: node, id: id, datatype: datatype}
+	d.properties[p.key()] = p
+	d.publish(p)
+	return p
+}
+
+func (d *Discovery) setSettable(p *property) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if p.settable {
+		return
+	}
+	p.settable = true
+	d.publish(p)
+}
+
+func (d *Discovery) config(p *property) (string, *config) {
+	e, ok := entities[p.key()]
+	if !ok {
+		e = defaultEntity(p.datatype, p.settable)
+	}
+	if e.component == "" {
+		return "", nil
+	}
+	stateTopic := d.topic(p.key())
+	c := &config{
+		Name:              fmt.Sprintf("%s %s", p.node, p.id),
+		UniqueID:          objectID(d.name, p.node, p.id),
+		ObjectID:          objectID(d.name, p.node, p.id),
+		DeviceClass:       e.deviceClass,
+		UnitOfMeasurement: e.unit,
+		StateClass:        e.stateClass,
+		Icon:              e.icon,
+		Min:               e.min,
+		Max:               e.max,
+		Availability: []availability{{
+			Topic:               d.topic("$state"),
+			ValueTemplate:       "{{ 'online' if value == 'ready' else 'offline' }}",
+			PayloadAvailable:    "online",
+			PayloadNotAvailable: "offline",
+		}},
+		Device: deviceInfo{
+			Identifiers:  []string{objectID(d.name)},
+			Name:         d.name,
+			Manufacturer: "mqtt-laptop-agent",
+			Model:        "homie",
+			SWVersion:    d.version,
+		},
+	}
+	switch e.component {
+	case "camera":
+		c.Topic = stateTopic
+	case "button":
+		c.CommandTopic = stateTopic + "/set"
+		c.PayloadPress = e.payloadPress
+	case "switch":
+		c.StateTopic = stateTopic
+		c.CommandTopic = stateTopic + "/set"
+		c.PayloadOn, c.PayloadOff = "true", "false"
+		c.StateOn, c.StateOff = "true", "false"
+	case "binary_sensor":
+		c.StateTopic = stateTopic
+		c.PayloadOn, c.PayloadOff = "true", "false"
+	case "number", "text":
+		c.StateTopic = stateTopic
+		c.CommandTopic = stateTopic + "/set"
+	default:
+		c.StateTopic = stateTopic
+	}
+	return fmt.Sprintf("%s/%s/%s/%s/config", d.prefix, e.component, objectID(d.name), objectID(p.node, p.id)), c
+}
+
+// publish must be called with d.mtx held.
+func (d *Discovery) publish(p *property) {
+	if d.client == nil || !d.client.IsConnected() {
+		return
+	}
+	topic, c := d.config(p)
+	if c == nil {
+		return
+	}
+	payload, err := json.Marshal(c)
+	if err != nil {
+		log.Errorf("failed to encode discovery config of %s: %v", p.key(), err)
+		return
+	}
+	d.client.Publish(topic, 1, true, payload)
+}
+
+// Publish sends the discovery config of every registered property through
+// client, which is then used for properties registered later.
+func (d *Discovery) Publish(client mqtt.Client) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.client = client
+	keys := make([]string, 0, len(d.properties))
+	for key := range d.properties {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		d.publish(d.properties[key])
+	}
+	log.Debugf("published %d Home Assistant discovery configs", len(keys))
+}
@@ -0,0 +1,66 @@
+package hass
+
+import (
+	homie "github.com/jbonachera/homie-go/homie"
+)
+
+type device struct {
+	homie.Device
+	discovery *Discovery
+}
+
+// WrapDevice returns a device registering every property it creates in d.
+func WrapDevice(dev homie.Device, d *Discovery) homie.Device {
+	return &device{Device: dev, discovery: d}
+}
+
+func (d *device) NewNode(id, name string) homie.Node {
+	return &node{Node: d.Device.NewNode(id, name), id: id, device: d}
+}
+
+type node struct {
+	homie.Node
+	id     string
+	device *device
+}
+
+func (n *node) ID() string {
+	return n.id
+}
+
+func (n *node) Device() homie.Device {
+	return n.device
+}
+
+func (n *node) NewProperty(id, datatype string) homie.Property {
+	return &wrappedProperty{
+		Property:   n.Node.NewProperty(id, datatype),
+		registered: n.device.discovery.register(n.id, id, datatype),
+		discovery:  n.device.discovery,
+	}
+}
+
+type wrappedProperty struct {
+	homie.Property
+	registered *property
+	discovery  *Discovery
+}
+
+func (p *wrappedProperty) SetValue(value string) homie.Property {
+	p.Property.SetValue(value)
+	return p
+}
+
+func (p *wrappedProperty) Publish() homie.Property {
+	p.Property.Publish()
+	return p
+}
+
+// SetHandler makes the property settable, which changes the kind of entity
+// exposed for properties without a known mapping.
+func (p *wrappedProperty) SetHandler(handler func(homie.Property, []byte, string) (bool, error)) {
+	p.discovery.setSettable(p.registered)
+	p.Property.SetHandler(func(_ homie.Property, payload []byte, topic string) (bool, error) {
+		return handler(p, payload, topic)
+	})
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	homie "github.com/jbonachera/homie-go/homie"
+	"github.com/jbonachera/mqtt-laptop-agent/logging"
+	"github.com/spf13/viper"
+)
+
+func setupLogging(config *viper.Viper) {
+	level, err := logging.ParseLevel(config.GetString("log.level"))
+	if err != nil {
+		log.Warnf("invalid log.level: %v", err)
+	}
+	logging.SetLevel(level)
+	if logging.UnderJournald() {
+		logging.SetOutput(logging.NewJournalSink("mqtt-agent"))
+		return
+	}
+	prefix := ""
+	if name := config.GetString("homie.name"); name != "" {
+		prefix = name + " "
+	}
+	logging.SetOutput(logging.NewTextSink(prefix))
+}
+
+// publishRemoteLevel exposes the level of logs streamed to
+// $implementation/logs, and lets it be changed by publishing to its set
+// topic.
+func publishRemoteLevel(device homie.Device, remote *logging.Remote) {
+	device.SendMessage("$implementation/logs/level", remote.Level().String())
+	device.SendMessage("$implementation/logs/level/$settable", "true")
+	device.Client().Subscribe(device.Topic("$implementation/logs/level/set"), 1, func(_ mqtt.Client, message mqtt.Message) {
+		level, err := logging.ParseLevel(string(message.Payload()))
+		if err != nil {
+			log.Warnf("refusing remote log level: %v", err)
+			return
+		}
+		remote.SetLevel(level)
+		log.Infof("remote log level set to %s", level)
+		device.SendMessage("$implementation/logs/level", level.String())
+	})
+}
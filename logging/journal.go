@@ -0,0 +1,56 @@
+package logging
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/coreos/go-systemd/journal"
+)
+
+var journalPriorities = map[Level]journal.Priority{
+	Debug:   journal.PriDebug,
+	Info:    journal.PriInfo,
+	Warning: journal.PriWarning,
+	Error:   journal.PriErr,
+}
+
+// UnderJournald tells whether stderr is connected to the systemd journal.
+func UnderJournald() bool {
+	return os.Getenv("JOURNAL_STREAM") != "" && journal.Enabled()
+}
+
+type journalSink struct {
+	identifier string
+}
+
+// NewJournalSink sends entries to journald with their fields, using
+// identifier as SYSLOG_IDENTIFIER.
+func NewJournalSink(identifier string) Sink {
+	return &journalSink{identifier: identifier}
+}
+
+func journalField(key string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, key)
+}
+
+func (j *journalSink) Write(entry Entry) {
+	vars := map[string]string{
+		"SYSLOG_IDENTIFIER": j.identifier,
+		"COMPONENT":         entry.Component,
+	}
+	for key, value := range entry.Fields {
+		vars[journalField(key)] = fmt.Sprintf("%v", value)
+	}
+	if err := journal.Send(entry.Message, journalPriorities[entry.Level], vars); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to write to journald: %v: %s\n", err, entry.Message)
+	}
+}
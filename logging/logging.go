@@ -0,0 +1,186 @@
+package logging
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Level int
+
+const (
+	Debug Level = iota
+	Info
+	Warning
+	Error
+)
+
+var levelNames = []string{"debug", "info", "warning", "error"}
+
+func (l Level) String() string {
+	if l < Debug || l > Error {
+		return "unknown"
+	}
+	return levelNames[l]
+}
+
+func ParseLevel(value string) (Level, error) {
+	for idx, name := range levelNames {
+		if strings.EqualFold(value, name) {
+			return Level(idx), nil
+		}
+	}
+	if strings.EqualFold(value, "warn") {
+		return Warning, nil
+	}
+	return Info, fmt.Errorf("unknown log level %q", value)
+}
+
+// Entry is a single structured log record.
+type Entry struct {
+	Time      time.Time              `json:"time"`
+	Level     Level                  `json:"-"`
+	LevelName string                 `json:"level"`
+	Component string                 `json:"component"`
+	Message   string                 `json:"message"`
+	Fields    map[string]interface{} `json:"fields,omitempty"`
+}
+
+// Sink receives every entry at or above its level.
+type Sink interface {
+	Write(entry Entry)
+}
+
+type sink struct {
+	Sink
+	level func() Level
+}
+
+var (
+	mtx   sync.Mutex
+	sinks = map[string]sink{}
+	level = Info
+)
+
+func init() {
+	sinks["output"] = sink{Sink: &textSink{prefix: ""}, level: localLevel}
+}
+
+func localLevel() Level {
+	mtx.Lock()
+	defer mtx.Unlock()
+	return level
+}
+
+// SetLevel sets the minimum level of the local output.
+func SetLevel(l Level) {
+	mtx.Lock()
+	defer mtx.Unlock()
+	level = l
+}
+
+// SetOutput replaces the local output, which is stderr by default.
+func SetOutput(s Sink) {
+	mtx.Lock()
+	defer mtx.Unlock()
+	sinks["output"] = sink{Sink: s, level: localLevel}
+}
+
+// AddSink registers an additional named sink, replacing any sink previously
+// registered under name.
+func AddSink(name string, s Sink, minLevel func() Level) {
+	mtx.Lock()
+	defer mtx.Unlock()
+	sinks[name] = sink{Sink: s, level: minLevel}
+}
+
+func dispatch(entry Entry) {
+	mtx.Lock()
+	targets := make([]sink, 0, len(sinks))
+	for _, s := range sinks {
+		targets = append(targets, s)
+	}
+	mtx.Unlock()
+	for _, s := range targets {
+		if entry.Level >= s.level() {
+			s.Write(entry)
+		}
+	}
+}
+
+// Logger writes entries tagged with a component name and optional fields.
+type Logger struct {
+	component string
+	fields    map[string]interface{}
+}
+
+func New(component string) *Logger {
+	return &Logger{component: component}
+}
+
+// With returns a logger adding key=value to every entry.
+func (l *Logger) With(key string, value interface{}) *Logger {
+	fields := make(map[string]interface{}, len(l.fields)+1)
+	for k, v := range l.fields {
+		fields[k] = v
+	}
+	fields[key] = value
+	return &Logger{component: l.component, fields: fields}
+}
+
+func (l *Logger) log(lvl Level, format string, args ...interface{}) {
+	dispatch(Entry{
+		Time:      time.Now(),
+		Level:     lvl,
+		LevelName: lvl.String(),
+		Component: l.component,
+		Message:   fmt.Sprintf(format, args...),
+		Fields:    l.fields,
+	})
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.log(Debug, format, args...)
+}
+
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.log(Info, format, args...)
+}
+
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.log(Warning, format, args...)
+}
+
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.log(Error, format, args...)
+}
+
+type textSink struct {
+	mtx    sync.Mutex
+	prefix string
+}
+
+// NewTextSink writes human readable lines to stderr, starting with prefix.
+func NewTextSink(prefix string) Sink {
+	return &textSink{prefix: prefix}
+}
+
+func (t *textSink) Write(entry Entry) {
+	line := &strings.Builder{}
+	fmt.Fprintf(line, "%s%s %-7s %s: %s", t.prefix, entry.Time.Format("2006/01/02 15:04:05"), strings.ToUpper(entry.LevelName), entry.Component, entry.Message)
+	keys := make([]string, 0, len(entry.Fields))
+	for key := range entry.Fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(line, " %s=%v", key, entry.Fields[key])
+	}
+	line.WriteString("\n")
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	os.Stderr.WriteString(line.String())
+}
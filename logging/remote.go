@@ -0,0 +1,68 @@
+package logging
+
+import (
+	"encoding/json"
+	"sync"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Remote publishes entries as JSON on an MQTT topic. Entries are dropped
+// while disconnected or when the broker cannot keep up, so that logging never
+// blocks the agent.
+type Remote struct {
+	mtx     sync.Mutex
+	level   Level
+	client  mqtt.Client
+	topic   string
+	entries chan Entry
+}
+
+func NewRemote(minLevel Level) *Remote {
+	r := &Remote{level: minLevel, entries: make(chan Entry, 100)}
+	go r.run()
+	AddSink("remote", r, r.Level)
+	return r
+}
+
+func (r *Remote) Level() Level {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.level
+}
+
+func (r *Remote) SetLevel(l Level) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.level = l
+}
+
+// Attach starts publishing entries to topic through client.
+func (r *Remote) Attach(client mqtt.Client, topic string) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.client, r.topic = client, topic
+}
+
+func (r *Remote) Write(entry Entry) {
+	select {
+	case r.entries <- entry:
+	default:
+	}
+}
+
+func (r *Remote) run() {
+	for entry := range r.entries {
+		r.mtx.Lock()
+		client, topic := r.client, r.topic
+		r.mtx.Unlock()
+		if client == nil || !client.IsConnected() {
+			continue
+		}
+		payload, err := json.Marshal(entry)
+		if err != nil {
+			continue
+		}
+		client.Publish(topic, 0, false, payload)
+	}
+}
@@ -2,10 +2,10 @@ package logind
 
 import (
 	"fmt"
-	"log"
 
 	dbus "github.com/godbus/dbus"
 	homie "github.com/jbonachera/homie-go/homie"
+	"github.com/jbonachera/mqtt-laptop-agent/property"
 )
 
 func lockProperty(node homie.Node, conn *dbus.Conn) {
@@ -16,20 +16,22 @@ func lockProperty(node homie.Node, conn *dbus.Conn) {
 	}
 	obj := conn.Object("org.freedesktop.login1", "/org/freedesktop/login1/session/self")
 
-	lock := node.NewProperty("lock", "bool")
+	lock := property.New("lock", property.Boolean).Build(node)
 
 	result, err := obj.GetProperty("org.freedesktop.login1.Session.LockedHint")
 	if err != nil {
-		log.Print(err)
+		log.Errorf("%v", err)
 	} else {
 		lock.SetValue(fmt.Sprintf("%v", result.Value().(bool)))
 	}
 
 	lock.SetHandler(func(p homie.Property, payload []byte, topic string) (bool, error) {
+		method := "org.freedesktop.login1.Session.Unlock"
 		if string(payload) == "true" {
-			obj.Call("org.freedesktop.login1.Session.Lock", 0).Store(nil)
-		} else {
-			obj.Call("org.freedesktop.login1.Session.Unlock", 0).Store(nil)
+			method = "org.freedesktop.login1.Session.Lock"
+		}
+		if err := obj.Call(method, 0).Store(); err != nil {
+			return false, err
 		}
 		return true, nil
 	})
@@ -39,6 +41,7 @@ func lockProperty(node homie.Node, conn *dbus.Conn) {
 
 	go func() {
 		for event := range c {
+			dbusSignals.Inc()
 			if len(event.Body) >= 2 {
 				if v, ok := event.Body[0].(string); ok && v == "org.freedesktop.login1.Session" {
 					data := event.Body[1].(map[string]dbus.Variant)
@@ -1,28 +1,65 @@
 package logind
 
 import (
+	"context"
 	"fmt"
-	"os"
 
 	dbus "github.com/godbus/dbus"
 	homie "github.com/jbonachera/homie-go/homie"
+	"github.com/jbonachera/mqtt-laptop-agent/logging"
+	"github.com/jbonachera/mqtt-laptop-agent/metrics"
+	"github.com/jbonachera/mqtt-laptop-agent/provider"
 )
 
+var log = logging.New("logind")
+
+var dbusSignals = metrics.NewCounter("agent_logind_dbus_signals_total", "D-Bus signals received by the logind provider.")
+
+func init() {
+	provider.Register(provider.Definition{
+		Name:     "logind",
+		NodeType: "logind",
+		New: func() provider.Provider {
+			return NewLogindProvider()
+		},
+	})
+}
+
 type logindProvider struct {
+	conn *dbus.Conn
 }
 
 func NewLogindProvider() *logindProvider {
 	return &logindProvider{}
 }
 
-func (l *logindProvider) Serve(node homie.Node) {
+func (l *logindProvider) Available() bool {
+	if l.conn != nil {
+		return true
+	}
 	systemBus, err := dbus.ConnectSystemBus()
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "Failed to connect to system bus:", err)
-		return
+		return false
 	}
+	l.conn = systemBus
+	return true
+}
 
-	lockProperty(node, systemBus)
-	suspendProperty(node, systemBus)
-	poweroffProperty(node, systemBus)
+func (l *logindProvider) Start(ctx context.Context, node homie.Node) error {
+	if !l.Available() {
+		return fmt.Errorf("failed to connect to system bus")
+	}
+	lockProperty(node, l.conn)
+	suspendProperty(node, l.conn)
+	poweroffProperty(node, l.conn)
+	return nil
+}
+
+func (l *logindProvider) Stop() error {
+	if l.conn == nil {
+		return nil
+	}
+	err := l.conn.Close()
+	l.conn = nil
+	return err
 }
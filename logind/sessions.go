@@ -0,0 +1,47 @@
+package logind
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	dbus "github.com/godbus/dbus"
+	"github.com/jbonachera/mqtt-laptop-agent/rpc"
+)
+
+type session struct {
+	ID   string `json:"id"`
+	UID  uint32 `json:"uid"`
+	User string `json:"user"`
+	Seat string `json:"seat"`
+}
+
+func (l *logindProvider) Methods() []rpc.Method {
+	return []rpc.Method{
+		{Name: "sessions", Timeout: 5 * time.Second, Handler: l.sessions},
+	}
+}
+
+// sessions lists the logind sessions of this machine.
+func (l *logindProvider) sessions(ctx context.Context, args json.RawMessage) (interface{}, error) {
+	if l.conn == nil {
+		return nil, errors.New("not connected to system bus")
+	}
+	var listed []struct {
+		ID   string
+		UID  uint32
+		User string
+		Seat string
+		Path dbus.ObjectPath
+	}
+	obj := l.conn.Object("org.freedesktop.login1", "/org/freedesktop/login1")
+	if err := obj.Call("org.freedesktop.login1.Manager.ListSessions", 0).Store(&listed); err != nil {
+		return nil, err
+	}
+	sessions := make([]session, len(listed))
+	for idx, s := range listed {
+		sessions[idx] = session{ID: s.ID, UID: s.UID, User: s.User, Seat: s.Seat}
+	}
+	return sessions, nil
+}
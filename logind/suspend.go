@@ -3,17 +3,20 @@ package logind
 import (
 	dbus "github.com/godbus/dbus"
 	homie "github.com/jbonachera/homie-go/homie"
+	"github.com/jbonachera/mqtt-laptop-agent/property"
 )
 
 func suspendProperty(node homie.Node, conn *dbus.Conn) {
 	obj := conn.Object("org.freedesktop.login1", "/org/freedesktop/login1")
 
-	suspend := node.NewProperty("suspend", "bool")
+	suspend := property.New("suspend", property.Boolean).Retained(false).Build(node)
 	suspend.SetValue("false")
 
 	suspend.SetHandler(func(p homie.Property, payload []byte, topic string) (bool, error) {
 		if string(payload) == "true" {
-			obj.Call("org.freedesktop.login1.Manager.Suspend", 0, false).Store(nil)
+			if err := obj.Call("org.freedesktop.login1.Manager.Suspend", 0, false).Store(); err != nil {
+				return false, err
+			}
 		}
 		return true, nil
 	})
@@ -1,25 +1,32 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
-	"log"
 	"os"
+	"os/signal"
+	"path"
 	"syscall"
 	"time"
 
 	homie "github.com/jbonachera/homie-go/homie"
-	"github.com/jbonachera/mqtt-laptop-agent/dafang"
-	"github.com/jbonachera/mqtt-laptop-agent/logind"
+	"github.com/jbonachera/mqtt-laptop-agent/enroll"
+	"github.com/jbonachera/mqtt-laptop-agent/hass"
+	"github.com/jbonachera/mqtt-laptop-agent/logging"
 	"github.com/jbonachera/mqtt-laptop-agent/ota"
-	"github.com/jbonachera/mqtt-laptop-agent/upower"
+	"github.com/jbonachera/mqtt-laptop-agent/property"
+	"github.com/jbonachera/mqtt-laptop-agent/provider"
+	"github.com/jbonachera/mqtt-laptop-agent/queue"
+	"github.com/jbonachera/mqtt-laptop-agent/rpc"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
-type Broadcast struct {
-	Level   string
-	Payload []byte
-}
+var log = logging.New("agent")
+
+// version is set at build time with -ldflags "-X main.version=...".
+var version = "dev"
 
 func main() {
 	config := viper.New()
@@ -27,88 +34,268 @@ func main() {
 	config.SetConfigType("yaml")
 	config.SetConfigName("config")
 	cmd := cobra.Command{
-		PersistentPreRun: func(cmd *cobra.Command, _ []string) {
-			config.BindEnv()
-			config.BindPFlags(cmd.Flags())
-			config.BindPFlags(cmd.PersistentFlags())
-			if err := config.ReadInConfig(); err != nil {
-				log.Printf("failed to load config: %v", err)
-			}
+		PersistentPreRunE: func(cmd *cobra.Command, _ []string) error {
+			return loadConfig(config, cmd)
 		},
 		Run: func(cmd *cobra.Command, args []string) {
-			log.SetPrefix(config.GetString("homie.name"))
+			log.Infof("starting agent version %s", version)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+			go func() {
+				sig := <-signals
+				log.Infof("received %v, shutting down", sig)
+				cancel()
+			}()
 			rebootCh := make(chan struct{})
+			otaDir := path.Join(dataDir(), "ota")
+			health := ota.WatchHealth(otaDir, config.GetDuration("ota.health-timeout"))
+			// A firmware unable to reach the broker never returns from
+			// connect, the rollback has to interrupt it.
+			go func() {
+				select {
+				case <-health.RolledBack():
+					log.Warnf("previous firmware restored, restarting")
+					cancel()
+				case <-ctx.Done():
+				}
+			}()
+			rolledBack := func() bool {
+				select {
+				case <-health.RolledBack():
+					return true
+				default:
+					return false
+				}
+			}
+			trustedKeys, err := ota.ParseTrustedKeys(config.GetStringSlice("ota.trusted-keys"))
+			if err != nil {
+				log.Errorf("failed to load OTA trusted keys, OTA updates will be refused: %v", err)
+			}
+
+			var certificates *tlsLoader
+			for _, b := range configuredBrokers(config) {
+				if isTLSBroker(b.URL) {
+					certificates, err = newTLSLoader()
+					if err != nil {
+						log.Errorf("failed to load TLS files: %v", err)
+					}
+					break
+				}
+			}
+			publishCertificateExpiry := func(device homie.Device) {
+				if certificates == nil || certificates.Expiry().IsZero() {
+					return
+				}
+				device.SendMessage("$implementation/tls/expiry", certificates.Expiry().UTC().Format(time.RFC3339))
+			}
 
+			outbox := newQueue(config)
+			remoteLevel, err := logging.ParseLevel(config.GetString("log.remote-level"))
+			if err != nil {
+				log.Warnf("invalid log.remote-level: %v", err)
+			}
+			remoteLogs := logging.NewRemote(remoteLevel)
 			notificationsProvider := NewNotificationsProvider()
-			broadcastCh := make(chan Broadcast, 5)
-			device := homie.NewDevice(config.GetString("homie.name"), &homie.Config{
+			notifier := &failureNotifier{
+				notify:   notificationsProvider.Notify,
+				interval: config.GetDuration("mqtt.notify-interval"),
+			}
+			applyCompat(config)
+			providers := provider.NewRegistry(config)
+			brokerConnectivity := newConnectivity()
+			var settings *reloader
+			var discovery *hass.Discovery
+			var methods *rpc.Server
+			var deviceConfig *homie.Config
+			connectionLost := make(chan struct{}, 1)
+			deviceConfig = &homie.Config{
 				Mqtt: homie.MqttConfig{
-					URL:      config.GetString("mqtt.broker"),
 					Username: config.GetString("mqtt.username"),
 					Password: config.GetString("mqtt.password"),
 					OnConnect: func(device homie.Device) {
 						notificationsProvider.Notify("connected")
-						ota.NewProvider(device.Topic(""), device.Client(), rebootCh)
-						device.SendMessage("$implementation/ota/enabled", "true")
+						brokerConnectivity.Set(true)
+						state, err := json.Marshal(connectionState{
+							Broker:      deviceConfig.Mqtt.URL,
+							ConnectedAt: time.Now().UTC(),
+							Failures:    notifier.Reset(),
+						})
+						if err == nil {
+							device.SendMessage("$implementation/mqtt/connection", string(state))
+						}
+						go func() {
+							if err := outbox.Replay(device.Client()); err != nil {
+								log.Errorf("failed to replay queued messages: %v", err)
+							}
+						}()
+						device.SendMessage("$fw/version", version)
+						remoteLogs.Attach(device.Client(), device.Topic("$implementation/logs"))
+						publishRemoteLevel(device, remoteLogs)
+						publishCertificateExpiry(device)
+						publishConfig(device, config)
+						property.Announce()
+						if discovery != nil {
+							discovery.Publish(device.Client())
+						}
+						if methods != nil {
+							methods.Attach(device.Client())
+						}
+						handleRemoteConfig(device, config, settings.Saved)
+						ota.NewProvider(device.Topic(""), device.Client(), ota.Config{
+							TrustedKeys: trustedKeys,
+							DataDir:     otaDir,
+							HistorySize: config.GetInt("ota.history-size"),
+							Version:     version,
+							Channel:     config.GetString("ota.channel"),
+						}, rebootCh)
+						device.SendMessage("$implementation/ota/enabled", fmt.Sprintf("%v", len(trustedKeys) > 0))
 					},
 					OnConnectionLost: func(device homie.Device, err error) {
-						notificationsProvider.Notify(fmt.Sprintf("connection lost: %v", err))
-					},
-					OnBroadcast: func(device homie.Device, level string, message []byte) {
-						log.Printf("broadcast received: %s <- %s", level, string(message))
+						log.Warnf("connection lost: %v", err)
+						brokerConnectivity.Set(false)
+						connectionFailures.Inc()
+						notifier.Failed(err)
 						select {
-						case broadcastCh <- Broadcast{
-							Level:   level,
-							Payload: message,
-						}:
+						case connectionLost <- struct{}{}:
 						default:
 						}
 					},
+					OnBroadcast: func(device homie.Device, level string, message []byte) {
+						log.Debugf("broadcast received: %s <- %s", level, string(message))
+						providers.Broadcast(level, message)
+					},
 				},
 				BaseTopic:           "devices/",
 				StatsReportInterval: 60,
-			})
-
-			notificationsProvider.Register(device)
-			logind.NewLogindProvider().Serve(device.NewNode("logind", "logind"))
-			upower.NewUpowerProvider().Serve(device.NewNode("upower", "upower"))
-			dafangProvider := dafang.NewProvider()
-			if dafangProvider.Available() {
-				dafangProvider.Serve(device.NewNode("dafang", "dafang"))
 			}
+			device := homie.NewDevice(config.GetString("homie.name"), deviceConfig)
 
-			webcam := &webcamProvider{path: config.GetString("webcam-path")}
-			webcam.RegisterNode(device)
-			for {
-				log.Printf("attempting to connect to %s", config.GetString("mqtt.broker"))
-				err := device.Connect()
-				if err == nil {
-					break
+			if certificates != nil {
+				certificates.Watch(30*time.Second, func() {
+					if device.Client() != nil && device.Client().IsConnected() {
+						publishCertificateExpiry(device)
+					}
+				})
+				go enroll.RenewLoop(ctx, device.Client, config.GetString("enroll.topic"), config.GetString("homie.name"), enrollPaths(), 12*time.Hour)
+			}
+			providerDevice := device
+			if config.GetBool("hass.enabled") {
+				discovery = hass.New(config.GetString("hass.prefix"), config.GetString("homie.name"), version, device.Topic)
+				providerDevice = hass.WrapDevice(device, discovery)
+			}
+			methods = rpc.New(ctx, device.Topic)
+			for _, prefix := range config.GetStringSlice("rpc.response-prefixes") {
+				methods.AllowResponsePrefix(prefix)
+			}
+			providers.Serve(methods)
+			providers.Start(ctx, queue.WrapDevice(providerDevice, outbox))
+			if addr := config.GetString("http.listen"); addr != "" {
+				serveStatus(ctx, addr, brokerConnectivity, providers, config.GetDuration("http.unhealthy-after"))
+			}
+			settings = newReloader(config, device, providers, remoteLogs, func() {
+				deviceConfig.Mqtt.Username = config.GetString("mqtt.username")
+				deviceConfig.Mqtt.Password = config.GetString("mqtt.password")
+				brokerConnectivity.Set(false)
+				select {
+				case connectionLost <- struct{}{}:
+				default:
 				}
-				msg := fmt.Sprintf("connection failed: %v", err)
-				notificationsProvider.Notify(msg)
-				<-time.After(3 * time.Second)
+			})
+			settings.Watch()
+			if err := connect(ctx, config, device, deviceConfig, certificates, notifier); err != nil {
+				log.Warnf("giving up connecting to MQTT: %v", err)
+				providers.Stop(config.GetDuration("shutdown-timeout"))
+				outbox.Flush()
+				if rolledBack() {
+					log.Infof("calling execve on previous firmware")
+					syscall.Exec(os.Args[0], os.Args, os.Environ())
+				}
+				return
 			}
+			// paho would only reconnect to the broker it lost: go through the
+			// brokers in priority order again instead. Reloads of the MQTT
+			// settings reconnect the same way.
 			go func() {
-				for broadcast := range broadcastCh {
-					if dafangProvider.Available() {
-						dafangProvider.Broadcast(broadcast.Level, broadcast.Payload)
+				for {
+					select {
+					case <-connectionLost:
+					case <-ctx.Done():
+						return
+					}
+					if err := device.Disconnect(); err != nil {
+						log.Debugf("failed to close lost MQTT connection: %v", err)
+					}
+					if err := connect(ctx, config, device, deviceConfig, certificates, notifier); err != nil {
+						log.Warnf("giving up reconnecting to MQTT: %v", err)
 					}
 				}
 			}()
+			health.Confirm()
+			reboot := true
 			select {
 			case <-rebootCh:
-				log.Printf("rebooting")
-				err := device.Disconnect()
-				if err != nil {
-					log.Printf("failed to cleanly disconnect from MQTT - rebooting anyway")
-				}
-				dafangProvider.Stop()
-				log.Printf("calling execve on new firmware")
-				syscall.Exec(os.Args[0], os.Args, os.Environ())
+				log.Infof("rebooting")
+			case <-ctx.Done():
+				reboot = rolledBack()
+			}
+			cancel()
+			providers.Stop(config.GetDuration("shutdown-timeout"))
+			device.SendMessage("$state", "disconnected")
+			err = device.Disconnect()
+			if err != nil {
+				log.Errorf("failed to cleanly disconnect from MQTT: %v", err)
+			}
+			outbox.Flush()
+			if !reboot {
+				log.Infof("agent stopped")
+				return
 			}
+			log.Infof("calling execve on new firmware")
+			syscall.Exec(os.Args[0], os.Args, os.Environ())
 		},
 	}
 	cmd.Flags().String("webcam-path", "/dev/video0", "")
-	cmd.Execute()
+	config.SetDefault("ota.health-timeout", 2*time.Minute)
+	config.SetDefault("shutdown-timeout", 10*time.Second)
+	config.SetDefault("mqtt.backoff.min", time.Second)
+	config.SetDefault("mqtt.backoff.max", 5*time.Minute)
+	config.SetDefault("mqtt.notify-interval", 5*time.Minute)
+	config.SetDefault("mqtt.discovery.timeout", 3*time.Second)
+	config.SetDefault("mqtt.discovery.priority", 100)
+	config.SetDefault("http.unhealthy-after", 5*time.Minute)
+	config.SetDefault("log.level", "info")
+	config.SetDefault("log.remote-level", "warning")
+	config.SetDefault("hass.prefix", hass.DefaultPrefix)
+	config.SetDefault("enroll.topic", "enrollment/")
+	config.SetDefault("queue.size", queue.DefaultSize)
+	config.SetDefault("queue.persist", true)
+	cmd.AddCommand(otaCommand(config))
+	cmd.AddCommand(enrollCommand(config))
+	cmd.AddCommand(configCommand(config))
+	if err := cmd.Execute(); err != nil {
+		os.Exit(1)
+	}
+}
+
+func newQueue(config *viper.Viper) *queue.Queue {
+	policies := map[string]queue.Policy{}
+	for key, value := range config.GetStringMapString("queue.policies") {
+		policy, err := queue.ParsePolicy(value)
+		if err != nil {
+			log.Warnf("ignoring queue policy of %s: %v", key, err)
+			continue
+		}
+		policies[key] = policy
+	}
+	queuePath := ""
+	if config.GetBool("queue.persist") {
+		queuePath = path.Join(dataDir(), "queue.json")
+	}
+	return queue.New(queue.Config{
+		Path:     queuePath,
+		Size:     config.GetInt("queue.size"),
+		Policies: policies,
+	})
 }
@@ -0,0 +1,216 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type metric interface {
+	write(w io.Writer)
+}
+
+var (
+	mtx     sync.Mutex
+	metrics = map[string]metric{}
+)
+
+func register(name string, m metric) {
+	mtx.Lock()
+	defer mtx.Unlock()
+	if _, ok := metrics[name]; ok {
+		panic(fmt.Sprintf("metric %s registered twice", name))
+	}
+	metrics[name] = m
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func header(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// Counter only goes up.
+type Counter struct {
+	mtx   sync.Mutex
+	name  string
+	help  string
+	value float64
+}
+
+func NewCounter(name, help string) *Counter {
+	c := &Counter{name: name, help: help}
+	register(name, c)
+	return c
+}
+
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+func (c *Counter) Add(v float64) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.value += v
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	header(w, c.name, c.help, "counter")
+	fmt.Fprintf(w, "%s %s\n", c.name, formatFloat(c.value))
+}
+
+// CounterVec is a family of counters partitioned by a single label.
+type CounterVec struct {
+	mtx    sync.Mutex
+	name   string
+	help   string
+	label  string
+	values map[string]float64
+}
+
+func NewCounterVec(name, help, label string) *CounterVec {
+	c := &CounterVec{name: name, help: help, label: label, values: map[string]float64{}}
+	register(name, c)
+	return c
+}
+
+func (c *CounterVec) Inc(value string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.values[value]++
+}
+
+func (c *CounterVec) Add(value string, v float64) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.values[value] += v
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	header(w, c.name, c.help, "counter")
+	values := make([]string, 0, len(c.values))
+	for value := range c.values {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	for _, value := range values {
+		fmt.Fprintf(w, "%s{%s=%q} %s\n", c.name, c.label, value, formatFloat(c.values[value]))
+	}
+}
+
+// Gauge can go up and down.
+type Gauge struct {
+	mtx   sync.Mutex
+	name  string
+	help  string
+	value float64
+}
+
+func NewGauge(name, help string) *Gauge {
+	g := &Gauge{name: name, help: help}
+	register(name, g)
+	return g
+}
+
+func (g *Gauge) Set(v float64) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	g.value = v
+}
+
+func (g *Gauge) write(w io.Writer) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	header(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.name, formatFloat(g.value))
+}
+
+// DefaultBuckets suits durations in seconds, from a few milliseconds to
+// several seconds.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type Histogram struct {
+	mtx     sync.Mutex
+	name    string
+	help    string
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	h := &Histogram{name: name, help: help, buckets: buckets, counts: make([]uint64, len(buckets))}
+	register(name, h)
+	return h
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	for idx, bound := range h.buckets {
+		if v <= bound {
+			h.counts[idx]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// Since observes the time elapsed since start, in seconds.
+func (h *Histogram) Since(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	header(w, h.name, h.help, "histogram")
+	for idx, bound := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", h.name, formatFloat(bound), h.counts[idx])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", h.name, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", h.name, h.count)
+}
+
+// Write dumps every registered metric using the Prometheus text format.
+func Write(w io.Writer) {
+	mtx.Lock()
+	names := make([]string, 0, len(metrics))
+	for name := range metrics {
+		names = append(names, name)
+	}
+	mtx.Unlock()
+	sort.Strings(names)
+	for _, name := range names {
+		mtx.Lock()
+		m := metrics[name]
+		mtx.Unlock()
+		m.write(w)
+	}
+}
+
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		buf := &strings.Builder{}
+		Write(buf)
+		io.WriteString(w, buf.String())
+	})
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/spf13/viper"
+)
+
+var brokerSchemes = []string{"tcp", "mqtt", "ssl", "tls", "tcps", "mqtts", "ws", "wss"}
+
+func checkBrokerURL(broker string) error {
+	u, err := url.Parse(broker)
+	if err != nil {
+		return err
+	}
+	for _, scheme := range brokerSchemes {
+		if u.Scheme == scheme {
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported scheme %q in broker %s, use one of %s", u.Scheme, broker, strings.Join(brokerSchemes, ", "))
+}
+
+// proxyURL returns the HTTP proxy websocket brokers are reached through, or
+// nil when mqtt.proxy is not set.
+func proxyURL(config *viper.Viper) (*url.URL, error) {
+	proxy := config.GetString("mqtt.proxy")
+	if proxy == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(proxy)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid mqtt.proxy %q: expected http://host:port", proxy)
+	}
+	return u, nil
+}
+
+// websocketOptions makes the WebSocket dialer of paho go through proxy with
+// HTTP CONNECT. The broker URL, and so the Host header and TLS server name,
+// are left untouched. Other transports ignore these options.
+func websocketOptions(proxy *url.URL) *mqtt.WebsocketOptions {
+	if proxy == nil {
+		return nil
+	}
+	return &mqtt.WebsocketOptions{Proxy: http.ProxyURL(proxy)}
+}
+
+func mqttClientOptions(config *viper.Viper, clientID string) (*mqtt.ClientOptions, error) {
+	brokers := configuredBrokers(config)
+	if len(brokers) == 0 {
+		return nil, errors.New("no MQTT broker configured")
+	}
+	return mqttBrokerOptions(config, clientID, brokers...)
+}
+
+func mqttBrokerOptions(config *viper.Viper, clientID string, brokers ...broker) (*mqtt.ClientOptions, error) {
+	options := mqtt.NewClientOptions().
+		SetClientID(clientID).
+		SetUsername(config.GetString("mqtt.username")).
+		SetPassword(config.GetString("mqtt.password"))
+	for _, b := range brokers {
+		options.AddBroker(b.URL)
+	}
+	proxy, err := proxyURL(config)
+	if err != nil {
+		return nil, err
+	}
+	if proxy != nil {
+		options.SetWebsocketOptions(websocketOptions(proxy))
+	}
+	// paho only takes a single TLS configuration, it is built for the first
+	// TLS broker of the list.
+	for _, b := range brokers {
+		if !isTLSBroker(b.URL) {
+			continue
+		}
+		certificates, err := newTLSLoader()
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig, err := certificates.Config(b.URL)
+		if err != nil {
+			return nil, err
+		}
+		options.SetTLSConfig(tlsConfig)
+		break
+	}
+	return options, nil
+}
@@ -1,19 +1,29 @@
 package main
 
 import (
-	"fmt"
-	"log"
-	"os"
+	"context"
 
 	dbus "github.com/godbus/dbus"
 	homie "github.com/jbonachera/homie-go/homie"
+	"github.com/jbonachera/mqtt-laptop-agent/property"
+	"github.com/jbonachera/mqtt-laptop-agent/provider"
 )
 
-func notify(conn *dbus.Conn, message string) {
+func init() {
+	provider.Register(provider.Definition{
+		Name:     "notifications",
+		NodeType: "Notifications",
+		New: func() provider.Provider {
+			return NewNotificationsProvider()
+		},
+	})
+}
+
+func notify(conn *dbus.Conn, message string) error {
 	obj := conn.Object("org.freedesktop.Notifications", "/org/freedesktop/Notifications")
-	obj.Call(
+	return obj.Call(
 		"org.freedesktop.Notifications.Notify", 0, "MQTT Agent",
-		uint32(0), "", "MQTT Agent", message, []string{}, map[string]interface{}{}, 6000)
+		uint32(0), "", "MQTT Agent", message, []string{}, map[string]interface{}{}, 6000).Err
 }
 
 type notificationsProvider struct {
@@ -23,25 +33,52 @@ type notificationsProvider struct {
 func NewNotificationsProvider() *notificationsProvider {
 	sessionBus, err := dbus.ConnectSessionBus()
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "Failed to connect to session bus:", err)
+		log.Warnf("failed to connect to session bus: %v", err)
 		return &notificationsProvider{}
 	}
 	return &notificationsProvider{conn: sessionBus}
 }
 
-func (n *notificationsProvider) Register(device homie.Device) {
+func (n *notificationsProvider) Available() bool {
+	return n.conn != nil
+}
+
+func (n *notificationsProvider) Start(ctx context.Context, notifications homie.Node) error {
+	message := property.New("message", property.String).Retained(false).Build(notifications)
+	message.SetHandler(func(p homie.Property, payload []byte, topic string) (bool, error) {
+		if err := notify(n.conn, string(payload)); err != nil {
+			return false, err
+		}
+		return true, nil
+	})
+	return nil
+}
+
+func (n *notificationsProvider) Stop() error {
+	if n.conn == nil {
+		return nil
+	}
+	return n.conn.Close()
+}
+func (n *notificationsProvider) BroadcastLevels() []string {
+	return []string{"notify", "alarm"}
+}
+
+// Broadcast shows notify and alarm broadcasts on the desktop.
+func (n *notificationsProvider) Broadcast(level string, payload []byte) {
 	if n.conn == nil {
 		return
 	}
-	notifications := device.NewNode("notifications", "Notifications")
-	message := notifications.NewProperty("message", "string")
-	message.SetHandler(func(p homie.Property, payload []byte, topic string) (bool, error) {
+	switch level {
+	case "notify":
 		notify(n.conn, string(payload))
-		return true, nil
-	})
+	case "alarm":
+		notify(n.conn, "Alarm: "+string(payload))
+	}
 }
+
 func (n *notificationsProvider) Notify(msg string) {
-	log.Println(msg)
+	log.Infof("%s", msg)
 	if n.conn == nil {
 		return
 	}
@@ -0,0 +1,91 @@
+package ota
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+var errInvalidPatch = errors.New("invalid patch")
+
+const bsdiffMagic = "BSDIFF40"
+
+// offtin decodes the sign-magnitude little-endian integers used by bsdiff.
+func offtin(buf []byte) int64 {
+	value := int64(binary.LittleEndian.Uint64(buf) & 0x7fffffffffffffff)
+	if buf[7]&0x80 != 0 {
+		return -value
+	}
+	return value
+}
+
+// bspatch applies a BSDIFF40 patch to old, streaming the result to dest.
+func bspatch(old io.ReaderAt, oldSize int64, dest io.Writer, patch []byte) error {
+	if len(patch) < 32 || string(patch[:8]) != bsdiffMagic {
+		return errInvalidPatch
+	}
+	ctrlLen := offtin(patch[8:16])
+	diffLen := offtin(patch[16:24])
+	newSize := offtin(patch[24:32])
+	if ctrlLen < 0 || diffLen < 0 || newSize < 0 || 32+ctrlLen+diffLen > int64(len(patch)) {
+		return errInvalidPatch
+	}
+	ctrl := bzip2.NewReader(bytes.NewReader(patch[32 : 32+ctrlLen]))
+	diff := bzip2.NewReader(bytes.NewReader(patch[32+ctrlLen : 32+ctrlLen+diffLen]))
+	extra := bzip2.NewReader(bytes.NewReader(patch[32+ctrlLen+diffLen:]))
+
+	buf := make([]byte, 32*1024)
+	oldBuf := make([]byte, len(buf))
+	header := make([]byte, 24)
+	oldPos, newPos := int64(0), int64(0)
+	for newPos < newSize {
+		if _, err := io.ReadFull(ctrl, header); err != nil {
+			return errInvalidPatch
+		}
+		diffSize, extraSize, seek := offtin(header[0:8]), offtin(header[8:16]), offtin(header[16:24])
+		if diffSize < 0 || extraSize < 0 || newPos+diffSize+extraSize > newSize {
+			return errInvalidPatch
+		}
+		for remaining := diffSize; remaining > 0; {
+			n := int64(len(buf))
+			if remaining < n {
+				n = remaining
+			}
+			if _, err := io.ReadFull(diff, buf[:n]); err != nil {
+				return errInvalidPatch
+			}
+			for i := range oldBuf[:n] {
+				oldBuf[i] = 0
+			}
+			if start, end := oldPos, oldPos+n; end > 0 && start < oldSize {
+				skip := int64(0)
+				if start < 0 {
+					skip, start = -start, 0
+				}
+				if end > oldSize {
+					end = oldSize
+				}
+				if _, err := old.ReadAt(oldBuf[skip:skip+end-start], start); err != nil && err != io.EOF {
+					return err
+				}
+			}
+			for i := range buf[:n] {
+				buf[i] += oldBuf[i]
+			}
+			if _, err := dest.Write(buf[:n]); err != nil {
+				return err
+			}
+			remaining -= n
+			oldPos += n
+		}
+		newPos += diffSize
+		if _, err := io.CopyN(dest, extra, extraSize); err != nil {
+			return errInvalidPatch
+		}
+		newPos += extraSize
+		oldPos += seek
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package ota
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+const maxChunkSize = 1 << 20
+
+var (
+	errInvalidManifest = errors.New("invalid manifest")
+	errInvalidChunk    = errors.New("invalid chunk")
+)
+
+// Manifest announces a chunked transfer. Size is the size of the gzipped
+// image, split in chunks of ChunkSize bytes; only the last chunk may be
+// shorter.
+type Manifest struct {
+	Checksum  string `json:"checksum"`
+	Size      int64  `json:"size"`
+	ChunkSize int64  `json:"chunk_size"`
+	Signature string `json:"signature,omitempty"`
+	Metadata
+}
+
+func (m Manifest) chunks() int {
+	return int((m.Size + m.ChunkSize - 1) / m.ChunkSize)
+}
+
+func (m Manifest) validate() error {
+	if m.Checksum == "" || m.Size <= 0 || m.ChunkSize <= 0 || m.ChunkSize > maxChunkSize {
+		return errInvalidManifest
+	}
+	return nil
+}
+
+type transfer struct {
+	Manifest Manifest `json:"manifest"`
+	Received []bool   `json:"received"`
+	dir      string
+}
+
+func (t *transfer) partPath() string {
+	return path.Join(t.dir, t.Manifest.Checksum+".gz.part")
+}
+
+// transferSuffix names transfer states, which share the OTA data directory
+// with the history and the pending update.
+const transferSuffix = ".transfer.json"
+
+func (t *transfer) statePath() string {
+	return path.Join(t.dir, t.Manifest.Checksum+transferSuffix)
+}
+
+func loadTransfer(dir string) (*transfer, error) {
+	states, err := filepath.Glob(path.Join(dir, "*"+transferSuffix))
+	if err != nil || len(states) == 0 {
+		return nil, err
+	}
+	buf, err := ioutil.ReadFile(states[0])
+	if err != nil {
+		return nil, err
+	}
+	t := &transfer{dir: dir}
+	err = json.Unmarshal(buf, t)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse transfer state %s: %v", states[0], err)
+	}
+	if t.Manifest.validate() != nil || len(t.Received) != t.Manifest.chunks() {
+		os.Remove(states[0])
+		return nil, errInvalidManifest
+	}
+	if _, err := os.Stat(t.partPath()); err != nil {
+		os.Remove(states[0])
+		return nil, err
+	}
+	return t, nil
+}
+
+func newTransfer(dir string, manifest Manifest) (*transfer, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTA data directory: %v", err)
+	}
+	clearTransfers(dir)
+	err = checkFreeSpace(dir, manifest.Size)
+	if err != nil {
+		return nil, err
+	}
+	t := &transfer{
+		Manifest: manifest,
+		Received: make([]bool, manifest.chunks()),
+		dir:      dir,
+	}
+	file, err := os.Create(t.partPath())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTA transfer file: %v", err)
+	}
+	defer file.Close()
+	err = file.Truncate(manifest.Size)
+	if err != nil {
+		return nil, fmt.Errorf("failed to allocate OTA transfer file: %v", err)
+	}
+	return t, t.save()
+}
+
+func clearTransfers(dir string) {
+	for _, pattern := range []string{"*" + transferSuffix, "*.gz.part"} {
+		matches, _ := filepath.Glob(path.Join(dir, pattern))
+		for _, match := range matches {
+			os.Remove(match)
+		}
+	}
+}
+
+func (t *transfer) save() error {
+	buf, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	tmp := t.statePath() + ".tmp"
+	err = ioutil.WriteFile(tmp, buf, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to save OTA transfer state: %v", err)
+	}
+	return os.Rename(tmp, t.statePath())
+}
+
+func (t *transfer) write(index int, payload []byte) error {
+	if index < 0 || index >= len(t.Received) {
+		return errInvalidChunk
+	}
+	offset := int64(index) * t.Manifest.ChunkSize
+	expected := t.Manifest.ChunkSize
+	if remaining := t.Manifest.Size - offset; remaining < expected {
+		expected = remaining
+	}
+	if int64(len(payload)) != expected {
+		return errInvalidChunk
+	}
+	if t.Received[index] {
+		return nil
+	}
+	file, err := os.OpenFile(t.partPath(), os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open OTA transfer file: %v", err)
+	}
+	defer file.Close()
+	_, err = file.WriteAt(payload, offset)
+	if err != nil {
+		return fmt.Errorf("failed to write OTA chunk: %v", err)
+	}
+	err = file.Sync()
+	if err != nil {
+		return fmt.Errorf("failed to sync OTA chunk: %v", err)
+	}
+	t.Received[index] = true
+	return t.save()
+}
+
+func (t *transfer) missing() []int {
+	missing := []int{}
+	for idx, received := range t.Received {
+		if !received {
+			missing = append(missing, idx)
+		}
+	}
+	return missing
+}
+
+func (t *transfer) received() int64 {
+	received := int64(0)
+	for idx, done := range t.Received {
+		if !done {
+			continue
+		}
+		if idx == len(t.Received)-1 {
+			received += t.Manifest.Size - int64(idx)*t.Manifest.ChunkSize
+		} else {
+			received += t.Manifest.ChunkSize
+		}
+	}
+	return received
+}
+
+func (t *transfer) complete() bool {
+	return len(t.missing()) == 0
+}
+
+func (t *transfer) remove() {
+	os.Remove(t.statePath())
+	os.Remove(t.partPath())
+}
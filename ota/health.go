@@ -0,0 +1,138 @@
+package ota
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// pendingUpdate is written before executing a new firmware, and removed once
+// the new firmware confirmed it is healthy.
+type pendingUpdate struct {
+	Previous   string    `json:"previous"`
+	From       string    `json:"from"`
+	To         string    `json:"to"`
+	Deadline   time.Time `json:"deadline,omitempty"`
+	RolledBack bool      `json:"rolled_back"`
+	Reason     string    `json:"reason,omitempty"`
+}
+
+func pendingPath(dir string) string {
+	return path.Join(dir, "pending.json")
+}
+
+func loadPending(dir string) (*pendingUpdate, error) {
+	buf, err := ioutil.ReadFile(pendingPath(dir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	pending := &pendingUpdate{}
+	return pending, json.Unmarshal(buf, pending)
+}
+
+func (u *pendingUpdate) save(dir string) error {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+	buf, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	tmp := pendingPath(dir) + ".tmp"
+	err = ioutil.WriteFile(tmp, buf, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, pendingPath(dir))
+}
+
+type HealthCheck struct {
+	mtx        sync.Mutex
+	dir        string
+	pending    *pendingUpdate
+	timer      *time.Timer
+	rolledBack chan struct{}
+}
+
+// WatchHealth starts the health check of a freshly installed firmware, if
+// any. Confirm must be called before the deadline, or the previous firmware
+// is restored and RolledBack is closed so the caller can execute it.
+func WatchHealth(dir string, timeout time.Duration) *HealthCheck {
+	h := &HealthCheck{dir: dir, rolledBack: make(chan struct{})}
+	if dir == "" {
+		return h
+	}
+	pending, err := loadPending(dir)
+	if err != nil {
+		log.Errorf("failed to load pending OTA update: %v", err)
+		os.Remove(pendingPath(dir))
+		return h
+	}
+	if pending == nil || pending.RolledBack {
+		return h
+	}
+	current, err := fingerprintFile(os.Args[0])
+	if err != nil || current != pending.To {
+		log.Infof("running firmware is not the pending OTA update, discarding health check")
+		os.Remove(pendingPath(dir))
+		return h
+	}
+	if pending.Deadline.IsZero() {
+		pending.Deadline = time.Now().Add(timeout)
+		err = pending.save(dir)
+		if err != nil {
+			log.Errorf("failed to save pending OTA update: %v", err)
+		}
+	}
+	log.Infof("waiting for firmware %s to become healthy before %s", pending.To, pending.Deadline.Format(time.RFC3339))
+	h.pending = pending
+	h.timer = time.AfterFunc(time.Until(pending.Deadline), h.rollback)
+	return h
+}
+
+func (h *HealthCheck) RolledBack() <-chan struct{} {
+	return h.rolledBack
+}
+
+func (h *HealthCheck) Confirm() {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	if h.pending == nil {
+		return
+	}
+	h.timer.Stop()
+	log.Infof("firmware %s is healthy", h.pending.To)
+	os.Remove(pendingPath(h.dir))
+	h.pending = nil
+}
+
+func (h *HealthCheck) rollback() {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	if h.pending == nil {
+		return
+	}
+	log.Warnf("firmware %s failed its health check, rolling back to %s", h.pending.To, h.pending.From)
+	err := os.Rename(h.pending.Previous, os.Args[0])
+	if err != nil {
+		log.Errorf("failed to restore previous firmware: %v", err)
+		os.Remove(pendingPath(h.dir))
+		h.pending = nil
+		return
+	}
+	h.pending.RolledBack = true
+	h.pending.Reason = "health check failed"
+	err = h.pending.save(h.dir)
+	if err != nil {
+		log.Errorf("failed to save OTA rollback: %v", err)
+	}
+	h.pending = nil
+	close(h.rolledBack)
+}
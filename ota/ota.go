@@ -4,19 +4,29 @@ import (
 	"bytes"
 	"compress/gzip"
 	"crypto/md5"
+	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
+	"net/http"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/jbonachera/mqtt-laptop-agent/logging"
+	"github.com/jbonachera/mqtt-laptop-agent/metrics"
 )
 
+var log = logging.New("ota")
+
 type MqttClient interface {
 	Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token
 	Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token
@@ -24,6 +34,7 @@ type MqttClient interface {
 
 var (
 	errChecksumMismatch = errors.New("checksum mismatch")
+	errNoMatchingDelta  = errors.New("delta does not apply to the running firmware")
 )
 
 type otaState int
@@ -31,14 +42,63 @@ type otaState int
 const (
 	initializing otaState = iota
 	readyState
+	receivingState
+	downloadingState
+	verifyingState
 	writingState
 	rebootingState
 )
 
+func (s otaState) String() string {
+	switch s {
+	case initializing:
+		return "initializing"
+	case readyState:
+		return "ready"
+	case receivingState:
+		return "receiving"
+	case downloadingState:
+		return "downloading"
+	case verifyingState:
+		return "verifying"
+	case writingState:
+		return "writing"
+	case rebootingState:
+		return "rebooting"
+	default:
+		return "unknown"
+	}
+}
+
+type Config struct {
+	TrustedKeys TrustedKeys
+	DataDir     string
+	HistorySize int
+	HTTPClient  *http.Client
+	Version     string
+	Channel     string
+}
+
 type provider struct {
-	mtx      sync.Mutex
-	state    otaState
-	checksum string
+	mtx        sync.Mutex
+	state      otaState
+	checksum   string
+	client     MqttClient
+	prefix     string
+	rebootCh   chan struct{}
+	dataDir    string
+	keys       TrustedKeys
+	signatures map[string][]byte
+	metadata   map[string]Metadata
+	announced  map[string]time.Time
+	version    string
+	channel    string
+	transfer   *transfer
+	pending    *pendingUpdate
+	history    *history
+	http       *http.Client
+	progress   Progress
+	reported   time.Time
 }
 
 func fingerprintFile(filePath string) (string, error) {
@@ -54,8 +114,47 @@ func fingerprintFile(filePath string) (string, error) {
 	return hex.EncodeToString(hash.Sum(nil)[:16]), nil
 
 }
-func (p *provider) runUpdate(recvChecksum string, message mqtt.Message) error {
-	p.state = writingState
+
+// decoder writes the new firmware image to dest.
+type decoder func(dest io.Writer) error
+
+func gunzip(payload io.Reader) decoder {
+	return func(dest io.Writer) error {
+		reader, err := gzip.NewReader(payload)
+		if err != nil {
+			return fmt.Errorf("failed to start gzip reader: %v", err)
+		}
+		defer reader.Close()
+		_, err = io.Copy(dest, reader)
+		return err
+	}
+}
+
+func patchSelf(patch []byte) decoder {
+	return func(dest io.Writer) error {
+		self, err := os.Open(os.Args[0])
+		if err != nil {
+			return fmt.Errorf("failed to open current firmware: %v", err)
+		}
+		defer self.Close()
+		stat, err := self.Stat()
+		if err != nil {
+			return fmt.Errorf("failed to stat current firmware: %v", err)
+		}
+		return bspatch(self, stat.Size(), dest, patch)
+	}
+}
+
+func (p *provider) runUpdate(recvChecksum string, signature []byte, meta Metadata, decode decoder) error {
+	p.pending = nil
+	if len(p.keys) == 0 {
+		return errNoTrustedKeys
+	}
+	if len(signature) == 0 {
+		return errUnsigned
+	}
+	p.state = verifyingState
+	p.publishProgress(true)
 	file, err := ioutil.TempFile("", "ota.*.homie")
 	if err != nil {
 		return fmt.Errorf("failed to create temp file to receive ota update: %v", err)
@@ -63,90 +162,493 @@ func (p *provider) runUpdate(recvChecksum string, message mqtt.Message) error {
 	defer os.Remove(file.Name())
 	defer file.Close()
 
-	reader, err := gzip.NewReader(bytes.NewReader(message.Payload()))
-	if err != nil {
-		return fmt.Errorf("failed to start gzip reader: %v", err)
+	digest := sha256.New()
+	err = decode(io.MultiWriter(file, digest))
+	if err == errInvalidPatch {
+		return err
 	}
-	defer reader.Close()
-	_, err = io.Copy(file, reader)
 	if err != nil {
 		return fmt.Errorf("failed to write ota update: %v", err)
 	}
+	// Deltas are applied from memory, and gzip may not read its trailer.
+	p.progress.Verified = p.progress.Total
 	hash, err := fingerprintFile(file.Name())
 	if err != nil {
 		return fmt.Errorf("failed to fingerprint ota update: %v", err)
 	}
 	if hash != recvChecksum {
-		log.Printf("recv checksum: %s", recvChecksum)
+		log.Debugf("recv checksum: %s", recvChecksum)
 		return errChecksumMismatch
 	}
+	err = p.keys.verify(signedMessage(digest.Sum(nil), meta), signature)
+	if err != nil {
+		return err
+	}
+	err = checkArchitecture(file)
+	if err != nil {
+		return err
+	}
+	p.state = writingState
+	p.publishProgress(true)
+	previous, err := install(file)
+	if err != nil {
+		return err
+	}
+	p.pending = &pendingUpdate{Previous: previous, From: p.checksum, To: recvChecksum}
+	return nil
+}
+
+// install atomically replaces the running firmware with image, keeping the
+// previous firmware next to it. It returns the path of the previous firmware.
+func install(image *os.File) (string, error) {
 	selfPath := os.Args[0]
-	seflStat, err := os.Stat(selfPath)
+	selfStat, err := os.Stat(selfPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to stat current firmware: %v", err)
+	}
+	newPath := selfPath + ".new"
+	previousPath := selfPath + ".previous"
+	imageStat, err := image.Stat()
 	if err != nil {
-		return fmt.Errorf("failed to stat current firmware: %v", err)
+		return "", fmt.Errorf("failed to stat new firmware: %v", err)
 	}
-	err = os.Remove(selfPath)
-	if err != nil && !os.IsNotExist(err) {
-		return fmt.Errorf("failed to delete current firmware: %v", err)
+	err = checkFreeSpace(filepath.Dir(selfPath), imageStat.Size())
+	if err != nil {
+		return "", err
 	}
-	dest, err := os.Create(selfPath)
+	dest, err := os.OpenFile(newPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, selfStat.Mode())
+	if err != nil {
+		return "", fmt.Errorf("failed to create new firmware: %v", err)
+	}
+	defer os.Remove(newPath)
 	defer dest.Close()
+	_, err = image.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", fmt.Errorf("failed to rewind new firmware: %v", err)
+	}
+	_, err = io.Copy(dest, image)
+	if err != nil {
+		return "", fmt.Errorf("failed to write new firmware: %v", err)
+	}
+	err = dest.Sync()
 	if err != nil {
-		return fmt.Errorf("failed to create new firmware: %v", err)
+		return "", fmt.Errorf("failed to sync new firmware: %v", err)
 	}
-	err = os.Chmod(dest.Name(), seflStat.Mode())
+	err = os.Chmod(newPath, selfStat.Mode())
 	if err != nil {
-		return fmt.Errorf("failed to change new firmware permissions: %v", err)
+		return "", fmt.Errorf("failed to change new firmware permissions: %v", err)
 	}
-	file.Seek(0, io.SeekStart)
-	_, err = io.Copy(dest, file)
+	os.Remove(previousPath)
+	err = os.Link(selfPath, previousPath)
 	if err != nil {
-		return fmt.Errorf("failed to move new firmware: %v", err)
+		return "", fmt.Errorf("failed to keep previous firmware: %v", err)
+	}
+	err = os.Rename(newPath, selfPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to move new firmware: %v", err)
+	}
+	return previousPath, nil
+}
+
+var updates = metrics.NewCounterVec("agent_ota_updates_total", "OTA update attempts, by resulting status.", "status")
+
+func (p *provider) publishStatus(status Status) {
+	updates.Inc(status.Status)
+	payload, err := json.Marshal(status)
+	if err != nil {
+		return
+	}
+	p.client.Publish(fmt.Sprintf("%sstatus", p.prefix), 1, true, payload).Wait()
+	err = p.history.add(status)
+	if err != nil {
+		log.Errorf("failed to save OTA history: %v", err)
+	}
+	p.publishHistory()
+}
+
+func (p *provider) publishHistory() {
+	payload, err := json.Marshal(p.history.entries)
+	if err != nil {
+		return
+	}
+	p.client.Publish(fmt.Sprintf("%shistory", p.prefix), 1, true, payload)
+}
+
+// publishProgress reports the current transfer progress, at most once per
+// second unless force is set.
+func (p *provider) publishProgress(force bool) {
+	if !force && time.Since(p.reported) < time.Second {
+		return
+	}
+	p.reported = time.Now()
+	p.progress.Phase = p.state.String()
+	payload, err := json.Marshal(p.progress)
+	if err != nil {
+		return
+	}
+	p.client.Publish(fmt.Sprintf("%sprogress", p.prefix), 0, true, payload)
+}
+
+func (p *provider) resetState() {
+	if p.transfer != nil {
+		p.state = receivingState
+		p.progress = Progress{Received: p.transfer.received(), Total: p.transfer.Manifest.Size}
+	} else {
+		p.state = readyState
+		p.progress = Progress{}
+	}
+	p.publishProgress(true)
+}
+
+func (p *provider) idle() bool {
+	return p.state == readyState || p.state == receivingState
+}
+
+func (p *provider) publishMissing(t *transfer) {
+	payload, err := json.Marshal(t.missing())
+	if err != nil {
+		return
+	}
+	p.client.Publish(fmt.Sprintf("%smissing/%s", p.prefix, t.Manifest.Checksum), 1, true, payload)
+}
+
+func (p *provider) clearTransfer() {
+	if p.transfer == nil {
+		return
+	}
+	p.client.Publish(fmt.Sprintf("%smissing/%s", p.prefix, p.transfer.Manifest.Checksum), 1, true, []byte{})
+	p.transfer.remove()
+	p.transfer = nil
+}
+
+// announcementTTL is how long a signature or metadata is kept while waiting
+// for its firmware.
+const announcementTTL = 30 * time.Minute
+
+// announce records that a signature or metadata was received for checksum,
+// and forgets the ones whose firmware never came.
+func (p *provider) announce(checksum string) {
+	now := time.Now()
+	p.announced[checksum] = now
+	for announced, at := range p.announced {
+		if now.Sub(at) > announcementTTL {
+			p.forget(announced)
+		}
+	}
+}
+
+func (p *provider) forget(checksum string) {
+	delete(p.signatures, checksum)
+	delete(p.metadata, checksum)
+	delete(p.announced, checksum)
+}
+
+// release returns and forgets the signature and metadata received for
+// checksum.
+func (p *provider) release(checksum string) ([]byte, Metadata) {
+	signature, meta := p.signatures[checksum], p.metadata[checksum]
+	p.forget(checksum)
+	return signature, meta
+}
+
+// restoreManifest remembers the signature and metadata embedded in manifest,
+// so that they are available once its last chunk is received.
+func (p *provider) restoreManifest(manifest Manifest) error {
+	if manifest.Signature != "" {
+		signature, err := parseSignature([]byte(manifest.Signature))
+		if err != nil {
+			return err
+		}
+		p.signatures[manifest.Checksum] = signature
 	}
+	if manifest.Version != "" {
+		p.metadata[manifest.Checksum] = manifest.Metadata
+	}
+	p.announce(manifest.Checksum)
 	return nil
 }
 
-func NewProvider(baseTopic string, client MqttClient, rebootCh chan struct{}) *provider {
-	p := &provider{}
+func (p *provider) newStatus(checksum string, meta Metadata, err error) Status {
+	status := newStatus(p.checksum, checksum, err)
+	status.FromVersion = p.version
+	status.ToVersion = meta.Version
+	return status
+}
+
+// update must be called with p.mtx held.
+func (p *provider) update(checksum string, signature []byte, meta Metadata, size int64, decode decoder) {
+	log.Infof("starting OTA Update to %s", meta.Version)
+	p.progress = Progress{Received: size, Total: size}
+	err := p.checkPolicy(meta)
+	if err == nil {
+		err = p.runUpdate(checksum, signature, meta, decode)
+	}
+	if err != nil {
+		log.Errorf("OTA Update failed: %v", err)
+		p.publishStatus(p.newStatus(checksum, meta, err))
+		p.resetState()
+		return
+	}
+	log.Infof("OTA Update succeeded")
+	if p.dataDir != "" {
+		err = p.pending.save(p.dataDir)
+		if err != nil {
+			log.Errorf("failed to save pending OTA update, new firmware will not be health checked: %v", err)
+		}
+	}
+	p.state = rebootingState
+	p.publishProgress(true)
+	p.publishStatus(p.newStatus(checksum, meta, nil))
+	close(p.rebootCh)
+}
+
+func NewProvider(baseTopic string, client MqttClient, config Config, rebootCh chan struct{}) *provider {
+	p := &provider{
+		client:     client,
+		prefix:     fmt.Sprintf("%s$implementation/ota/", baseTopic),
+		rebootCh:   rebootCh,
+		dataDir:    config.DataDir,
+		keys:       config.TrustedKeys,
+		signatures: map[string][]byte{},
+		metadata:   map[string]Metadata{},
+		announced:  map[string]time.Time{},
+		version:    config.Version,
+		channel:    config.Channel,
+		history:    loadHistory(config.DataDir, config.HistorySize),
+		http:       config.HTTPClient,
+	}
+	if p.http == nil {
+		p.http = &http.Client{Timeout: 30 * time.Minute}
+	}
+	if p.channel == "" {
+		p.channel = DefaultChannel
+	}
+	if channelRank(p.channel) < 0 {
+		log.Warnf("unknown OTA channel %q, all updates will be refused", p.channel)
+	}
 
 	selfHash, err := fingerprintFile(os.Args[0])
 	if err == nil {
-		log.Printf("starting OTA receiver with version %s", selfHash)
+		log.Infof("starting OTA receiver with version %s", selfHash)
 		p.checksum = selfHash
 	}
-	prefix := fmt.Sprintf("%s$implementation/ota/", baseTopic)
-	publishStatus := func(status string) {
-		client.Publish(fmt.Sprintf("%sstatus", prefix), 1, true, status).Wait()
+	prefix := p.prefix
+	if p.dataDir != "" {
+		pending, err := loadPending(p.dataDir)
+		if err == nil && pending != nil && pending.RolledBack {
+			log.Warnf("OTA update to %s was rolled back: %s", pending.To, pending.Reason)
+			status := newStatus(pending.From, pending.To, nil)
+			status.Code, status.Status, status.Error = 503, "ROLLED_BACK", pending.Reason
+			p.publishStatus(status)
+			os.Remove(pendingPath(p.dataDir))
+		}
+		p.transfer, err = loadTransfer(p.dataDir)
+		if err != nil {
+			log.Warnf("discarding OTA transfer state: %v", err)
+		}
+		if p.transfer != nil {
+			if err := p.restoreManifest(p.transfer.Manifest); err != nil {
+				log.Warnf("manifest of OTA transfer %s has an invalid signature: %v", p.transfer.Manifest.Checksum, err)
+			}
+			log.Infof("resuming OTA transfer of %s", p.transfer.Manifest.Checksum)
+			p.publishMissing(p.transfer)
+		}
 	}
+	p.publishHistory()
+	client.Publish(fmt.Sprintf("%schecksum", prefix), 1, true, p.checksum)
+	client.Publish(fmt.Sprintf("%sarch", prefix), 1, true, runtime.GOARCH)
+	client.Publish(fmt.Sprintf("%schannel", prefix), 1, true, p.channel)
+	// Signatures and metadata must be published, and acknowledged by the
+	// broker, before the firmware, delta or pull request they describe: an
+	// image received first is refused as unsigned.
+	client.Subscribe(fmt.Sprintf("%smetadata/+", prefix), 1, func(client mqtt.Client, message mqtt.Message) {
+		checksum := strings.TrimPrefix(message.Topic(), fmt.Sprintf("%smetadata/", prefix))
+		meta := Metadata{}
+		err := json.Unmarshal(message.Payload(), &meta)
+		if err != nil {
+			log.Warnf("refusing OTA metadata for %s: %v", checksum, err)
+			return
+		}
+		p.mtx.Lock()
+		defer p.mtx.Unlock()
+		p.metadata[checksum] = meta
+		p.announce(checksum)
+	})
+	client.Subscribe(fmt.Sprintf("%ssignature/+", prefix), 1, func(client mqtt.Client, message mqtt.Message) {
+		checksum := strings.TrimPrefix(message.Topic(), fmt.Sprintf("%ssignature/", prefix))
+		signature, err := parseSignature(message.Payload())
+		if err != nil {
+			log.Warnf("refusing OTA signature for %s: %v", checksum, err)
+			return
+		}
+		p.mtx.Lock()
+		defer p.mtx.Unlock()
+		p.signatures[checksum] = signature
+		p.announce(checksum)
+	})
 	client.Subscribe(fmt.Sprintf("%sfirmware/+", prefix), 1, func(client mqtt.Client, message mqtt.Message) {
 		p.mtx.Lock()
 		defer p.mtx.Unlock()
-		if message.Retained() || p.state != readyState {
-			log.Print("refusing to treat OTA update: state is not ready or message is retained")
+		if message.Retained() || !p.idle() {
+			log.Warnf("refusing to treat OTA update: state is not ready or message is retained")
 			return
 		}
 		checksum := strings.TrimPrefix(message.Topic(), fmt.Sprintf("%sfirmware/", prefix))
 		if checksum == p.checksum {
-			log.Print("refusing to treat OTA update: firmware is up to date with request")
+			log.Warnf("refusing to treat OTA update: firmware is up to date with request")
 			return
 		}
-		log.Print("starting OTA Update")
-		err := p.runUpdate(checksum, message)
+		signature, meta := p.release(checksum)
+		p.update(checksum, signature, meta, int64(len(message.Payload())), gunzip(progressReader{p: p, r: bytes.NewReader(message.Payload())}))
+	})
+	client.Subscribe(fmt.Sprintf("%sdelta/+/+", prefix), 1, func(client mqtt.Client, message mqtt.Message) {
+		p.mtx.Lock()
+		defer p.mtx.Unlock()
+		tokens := strings.Split(strings.TrimPrefix(message.Topic(), fmt.Sprintf("%sdelta/", prefix)), "/")
+		if len(tokens) != 2 || message.Retained() || !p.idle() {
+			log.Warnf("refusing to treat OTA delta: state is not ready or message is retained")
+			return
+		}
+		source, target := tokens[0], tokens[1]
+		if target == p.checksum {
+			log.Warnf("refusing to treat OTA delta: firmware is up to date with request")
+			return
+		}
+		if source != p.checksum {
+			log.Warnf("refusing to treat OTA delta: running %s, delta applies to %s", p.checksum, source)
+			p.publishStatus(p.newStatus(target, p.metadata[target], errNoMatchingDelta))
+			return
+		}
+		signature, meta := p.release(target)
+		p.update(target, signature, meta, int64(len(message.Payload())), patchSelf(message.Payload()))
+	})
+	client.Subscribe(fmt.Sprintf("%spull", prefix), 1, func(client mqtt.Client, message mqtt.Message) {
+		p.mtx.Lock()
+		defer p.mtx.Unlock()
+		if message.Retained() || !p.idle() || p.dataDir == "" {
+			log.Warnf("refusing OTA pull request: state is not ready, message is retained or no data directory is configured")
+			return
+		}
+		request, err := parsePullRequest(message.Payload())
 		if err != nil {
-			log.Printf("OTA Update failed: %v", err)
-			p.state = readyState
-			if err == errChecksumMismatch {
-				publishStatus("400 BAD_CHECKSUM")
-			} else {
-				publishStatus(fmt.Sprintf("500 %v", err))
+			log.Warnf("refusing OTA pull request: %v", err)
+			p.publishStatus(p.newStatus(request.Checksum, request.Metadata, err))
+			return
+		}
+		if request.Checksum == p.checksum {
+			log.Warnf("refusing OTA pull request: firmware is up to date with request")
+			return
+		}
+		signature, meta := p.release(request.Checksum)
+		if request.Version != "" {
+			meta = request.Metadata
+		}
+		if request.Signature != "" {
+			signature, err = parseSignature([]byte(request.Signature))
+			if err != nil {
+				log.Warnf("refusing OTA pull request: %v", err)
+				p.publishStatus(p.newStatus(request.Checksum, meta, errBadSignature))
+				return
 			}
+		}
+		err = os.MkdirAll(p.dataDir, 0700)
+		if err == nil {
+			clearDownloads(p.dataDir, request.Checksum)
+			err = checkFreeSpace(p.dataDir, request.Size)
+		}
+		if err != nil {
+			log.Warnf("refusing OTA pull request: %v", err)
+			p.publishStatus(p.newStatus(request.Checksum, meta, err))
+			return
+		}
+		log.Infof("downloading OTA update %s from %s", request.Checksum, request.URL)
+		p.state = downloadingState
+		p.progress = Progress{Total: request.Size}
+		p.publishProgress(true)
+		go p.pull(p.http, request, signature, meta)
+	})
+	client.Subscribe(fmt.Sprintf("%smanifest/+", prefix), 1, func(client mqtt.Client, message mqtt.Message) {
+		p.mtx.Lock()
+		defer p.mtx.Unlock()
+		if message.Retained() || !p.idle() || p.dataDir == "" {
+			log.Warnf("refusing OTA manifest: state is not ready, message is retained or no data directory is configured")
+			return
+		}
+		checksum := strings.TrimPrefix(message.Topic(), fmt.Sprintf("%smanifest/", prefix))
+		if checksum == p.checksum {
+			log.Warnf("refusing OTA manifest: firmware is up to date with request")
+			return
+		}
+		manifest := Manifest{}
+		err := json.Unmarshal(message.Payload(), &manifest)
+		if err == nil {
+			err = manifest.validate()
+		}
+		if err != nil || manifest.Checksum != checksum {
+			log.Warnf("refusing OTA manifest for %s: %v", checksum, err)
+			p.publishStatus(p.newStatus(checksum, manifest.Metadata, errInvalidManifest))
+			return
+		}
+		if err := p.restoreManifest(manifest); err != nil {
+			log.Warnf("refusing OTA manifest for %s: %v", checksum, err)
+			p.publishStatus(p.newStatus(checksum, manifest.Metadata, errBadSignature))
+			return
+		}
+		if p.transfer != nil && p.transfer.Manifest == manifest {
+			log.Infof("resuming OTA transfer of %s", checksum)
+			p.publishMissing(p.transfer)
+			return
+		}
+		p.clearTransfer()
+		p.transfer, err = newTransfer(p.dataDir, manifest)
+		if err != nil {
+			log.Errorf("failed to start OTA transfer: %v", err)
+			p.transfer = nil
+			p.publishStatus(p.newStatus(checksum, manifest.Metadata, err))
+			p.resetState()
+			return
+		}
+		log.Infof("starting OTA transfer of %s: %d chunks", checksum, manifest.chunks())
+		p.resetState()
+		p.publishMissing(p.transfer)
+	})
+	client.Subscribe(fmt.Sprintf("%schunk/+/+", prefix), 1, func(client mqtt.Client, message mqtt.Message) {
+		p.mtx.Lock()
+		defer p.mtx.Unlock()
+		tokens := strings.Split(strings.TrimPrefix(message.Topic(), fmt.Sprintf("%schunk/", prefix)), "/")
+		if len(tokens) != 2 || p.state != receivingState || p.transfer == nil || p.transfer.Manifest.Checksum != tokens[0] {
+			return
+		}
+		checksum := tokens[0]
+		index, err := strconv.Atoi(tokens[1])
+		if err == nil {
+			err = p.transfer.write(index, message.Payload())
+		}
+		if err != nil {
+			log.Warnf("refusing OTA chunk %s: %v", tokens[1], err)
+			return
+		}
+		client.Publish(fmt.Sprintf("%sack/%s", prefix, checksum), 1, false, strconv.Itoa(index))
+		p.progress.Received = p.transfer.received()
+		if !p.transfer.complete() {
+			p.publishProgress(false)
+			return
+		}
+		p.publishMissing(p.transfer)
+		file, err := os.Open(p.transfer.partPath())
+		if err != nil {
+			log.Errorf("failed to open OTA transfer: %v", err)
+			p.clearTransfer()
+			p.publishStatus(p.newStatus(checksum, p.metadata[checksum], err))
+			p.resetState()
 			return
 		}
-		log.Print("OTA Update succeeded")
-		p.state = rebootingState
-		publishStatus("200")
-		close(rebootCh)
+		defer file.Close()
+		size := p.transfer.Manifest.Size
+		p.clearTransfer()
+		signature, meta := p.release(checksum)
+		p.update(checksum, signature, meta, size, gunzip(progressReader{p: p, r: file}))
 	})
-	p.state = readyState
+	p.resetState()
 	return p
 }
@@ -0,0 +1,69 @@
+package ota
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"syscall"
+)
+
+var (
+	errWrongArchitecture = errors.New("firmware does not match device architecture")
+	errNoSpace           = errors.New("not enough free space to install firmware")
+)
+
+type elfTarget struct {
+	machine elf.Machine
+	class   elf.Class
+	order   binary.ByteOrder
+}
+
+var elfTargets = map[string]elfTarget{
+	"386":      {elf.EM_386, elf.ELFCLASS32, binary.LittleEndian},
+	"amd64":    {elf.EM_X86_64, elf.ELFCLASS64, binary.LittleEndian},
+	"arm":      {elf.EM_ARM, elf.ELFCLASS32, binary.LittleEndian},
+	"arm64":    {elf.EM_AARCH64, elf.ELFCLASS64, binary.LittleEndian},
+	"mips":     {elf.EM_MIPS, elf.ELFCLASS32, binary.BigEndian},
+	"mipsle":   {elf.EM_MIPS, elf.ELFCLASS32, binary.LittleEndian},
+	"mips64":   {elf.EM_MIPS, elf.ELFCLASS64, binary.BigEndian},
+	"mips64le": {elf.EM_MIPS, elf.ELFCLASS64, binary.LittleEndian},
+	"ppc64le":  {elf.EM_PPC64, elf.ELFCLASS64, binary.LittleEndian},
+	"riscv64":  {elf.EM_RISCV, elf.ELFCLASS64, binary.LittleEndian},
+}
+
+// checkArchitecture makes sure image is an ELF executable runnable on the
+// current architecture.
+func checkArchitecture(image io.ReaderAt) error {
+	target, ok := elfTargets[runtime.GOARCH]
+	if !ok {
+		return nil
+	}
+	file, err := elf.NewFile(image)
+	if err != nil {
+		return fmt.Errorf("%w: not an ELF file: %v", errWrongArchitecture, err)
+	}
+	defer file.Close()
+	if file.Type != elf.ET_EXEC && file.Type != elf.ET_DYN {
+		return fmt.Errorf("%w: ELF file is not an executable", errWrongArchitecture)
+	}
+	if file.Machine != target.machine || file.Class != target.class || file.ByteOrder != target.order {
+		return fmt.Errorf("%w: image is %s %s %s, device is %s", errWrongArchitecture, file.Machine, file.Class, file.ByteOrder, runtime.GOARCH)
+	}
+	return nil
+}
+
+func checkFreeSpace(dir string, needed int64) error {
+	stat := syscall.Statfs_t{}
+	err := syscall.Statfs(dir, &stat)
+	if err != nil {
+		return fmt.Errorf("failed to stat filesystem of %s: %v", dir, err)
+	}
+	available := uint64(stat.Bavail) * uint64(stat.Bsize)
+	if available < uint64(needed) {
+		return fmt.Errorf("%w: %s has %d bytes available, %d needed", errNoSpace, dir, available, needed)
+	}
+	return nil
+}
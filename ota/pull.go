@@ -0,0 +1,177 @@
+package ota
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+var errInvalidPullRequest = errors.New("invalid pull request")
+
+const pullAttempts = 5
+
+// PullRequest asks the device to download a gzipped firmware image over
+// HTTP(S) instead of receiving it through the broker.
+type PullRequest struct {
+	URL       string `json:"url"`
+	Size      int64  `json:"size"`
+	Checksum  string `json:"checksum"`
+	Signature string `json:"signature,omitempty"`
+	Metadata
+}
+
+func (r PullRequest) validate() error {
+	if r.Checksum == "" || r.Size <= 0 {
+		return errInvalidPullRequest
+	}
+	u, err := url.Parse(r.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return errInvalidPullRequest
+	}
+	return nil
+}
+
+func downloadPath(dir, checksum string) string {
+	return path.Join(dir, checksum+".gz.download")
+}
+
+func clearDownloads(dir, keep string) {
+	matches, _ := filepath.Glob(path.Join(dir, "*.gz.download"))
+	for _, match := range matches {
+		if match != downloadPath(dir, keep) {
+			os.Remove(match)
+		}
+	}
+}
+
+type downloadWriter struct {
+	p    *provider
+	file *os.File
+}
+
+func (w downloadWriter) Write(b []byte) (int, error) {
+	n, err := w.file.Write(b)
+	w.p.mtx.Lock()
+	w.p.progress.Received += int64(n)
+	w.p.publishProgress(false)
+	w.p.mtx.Unlock()
+	return n, err
+}
+
+// download fetches the image described by request into the OTA data
+// directory, resuming from any partial download left by a previous attempt.
+func (p *provider) download(client *http.Client, request PullRequest) (string, error) {
+	dest := downloadPath(p.dataDir, request.Checksum)
+	file, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return "", fmt.Errorf("failed to create download file: %v", err)
+	}
+	defer file.Close()
+	var lastErr error
+	for attempt := 0; attempt < pullAttempts; attempt++ {
+		if attempt > 0 {
+			log.Warnf("OTA download interrupted, retrying: %v", lastErr)
+			<-time.After(time.Duration(attempt) * 5 * time.Second)
+		}
+		offset, err := file.Seek(0, io.SeekEnd)
+		if err != nil {
+			return "", err
+		}
+		if offset > request.Size {
+			file.Truncate(0)
+			offset, _ = file.Seek(0, io.SeekStart)
+		}
+		if offset == request.Size {
+			return dest, nil
+		}
+		p.mtx.Lock()
+		p.progress.Received = offset
+		p.mtx.Unlock()
+		lastErr = p.fetch(client, request, file, offset)
+		if lastErr == nil {
+			return dest, nil
+		}
+	}
+	return "", lastErr
+}
+
+func (p *provider) fetch(client *http.Client, request PullRequest, file *os.File, offset int64) error {
+	req, err := http.NewRequest(http.MethodGet, request.URL, nil)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if offset > 0 {
+			log.Infof("server does not support resuming downloads, restarting from scratch")
+			err = file.Truncate(0)
+			if err != nil {
+				return err
+			}
+			_, err = file.Seek(0, io.SeekStart)
+			if err != nil {
+				return err
+			}
+			p.mtx.Lock()
+			p.progress.Received = 0
+			p.mtx.Unlock()
+			offset = 0
+		}
+	case http.StatusPartialContent:
+	default:
+		return fmt.Errorf("unexpected HTTP status: %s", resp.Status)
+	}
+	written, err := io.Copy(downloadWriter{p: p, file: file}, io.LimitReader(resp.Body, request.Size-offset))
+	if err != nil {
+		return err
+	}
+	if offset+written != request.Size {
+		return fmt.Errorf("short download: got %d bytes out of %d", offset+written, request.Size)
+	}
+	return file.Sync()
+}
+
+func (p *provider) pull(client *http.Client, request PullRequest, signature []byte, meta Metadata) {
+	dest, err := p.download(client, request)
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if err != nil {
+		log.Errorf("OTA download failed: %v", err)
+		p.publishStatus(p.newStatus(request.Checksum, meta, err))
+		p.resetState()
+		return
+	}
+	defer os.Remove(dest)
+	file, err := os.Open(dest)
+	if err != nil {
+		p.publishStatus(p.newStatus(request.Checksum, meta, err))
+		p.resetState()
+		return
+	}
+	defer file.Close()
+	p.update(request.Checksum, signature, meta, request.Size, gunzip(progressReader{p: p, r: file}))
+}
+
+func parsePullRequest(payload []byte) (PullRequest, error) {
+	request := PullRequest{}
+	err := json.Unmarshal(payload, &request)
+	if err != nil {
+		return request, fmt.Errorf("%w: %v", errInvalidPullRequest, err)
+	}
+	return request, request.validate()
+}
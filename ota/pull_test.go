@@ -0,0 +1,244 @@
+package ota
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+type token struct {
+	mqtt.Token
+}
+
+func (token) Wait() bool   { return true }
+func (token) Error() error { return nil }
+
+// fakeClient records the messages published by the provider.
+type fakeClient struct {
+	mtx       sync.Mutex
+	published map[string][]byte
+}
+
+func (c *fakeClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	switch v := payload.(type) {
+	case []byte:
+		c.published[topic] = v
+	case string:
+		c.published[topic] = []byte(v)
+	}
+	return token{}
+}
+
+func (c *fakeClient) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	return token{}
+}
+
+const testPrefix = "devices/laptop/$implementation/ota/"
+
+func testProvider(t *testing.T, keys TrustedKeys) (*provider, *fakeClient) {
+	dir, err := ioutil.TempDir("", "ota")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	client := &fakeClient{published: map[string][]byte{}}
+	return &provider{
+		client:     client,
+		prefix:     testPrefix,
+		rebootCh:   make(chan struct{}),
+		dataDir:    dir,
+		keys:       keys,
+		signatures: map[string][]byte{},
+		metadata:   map[string]Metadata{},
+		announced:  map[string]time.Time{},
+		version:    "1.0.0",
+		channel:    DefaultChannel,
+		history:    loadHistory(dir, 10),
+		http:       http.DefaultClient,
+	}, client
+}
+
+func gzipped(t *testing.T, image []byte) []byte {
+	buf := &bytes.Buffer{}
+	writer := gzip.NewWriter(buf)
+	if _, err := writer.Write(image); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// checksum fingerprints b like the provider does with received images.
+func checksum(t *testing.T, b []byte) string {
+	file, err := ioutil.TempFile("", "image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	if _, err := file.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	sum, err := fingerprintFile(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sum
+}
+
+// rangeServer serves payload, honoring the Range headers of resumed
+// downloads, and records the ranges it was asked for.
+func rangeServer(t *testing.T, payload []byte, ranges *[]string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Range")
+		*ranges = append(*ranges, header)
+		if header == "" {
+			w.Write(payload)
+			return
+		}
+		var offset int
+		if _, err := fmt.Sscanf(header, "bytes=%d-", &offset); err != nil || offset > len(payload) {
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, len(payload)-1, len(payload)))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(payload[offset:])
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestDownload(t *testing.T) {
+	payload := gzipped(t, bytes.Repeat([]byte("firmware"), 4096))
+	ranges := []string{}
+	server := rangeServer(t, payload, &ranges)
+	p, _ := testProvider(t, nil)
+	request := PullRequest{URL: server.URL, Size: int64(len(payload)), Checksum: "abcd"}
+	dest, err := p.download(server.Client(), request)
+	if err != nil {
+		t.Fatalf("download failed: %v", err)
+	}
+	got, err := ioutil.ReadFile(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Errorf("downloaded %d bytes, expected %d", len(got), len(payload))
+	}
+	if len(ranges) != 1 || ranges[0] != "" {
+		t.Errorf("unexpected requests: %q", ranges)
+	}
+	if p.progress.Received != request.Size {
+		t.Errorf("progress reports %d bytes, expected %d", p.progress.Received, request.Size)
+	}
+}
+
+func TestDownloadResume(t *testing.T) {
+	payload := gzipped(t, bytes.Repeat([]byte("firmware"), 4096))
+	ranges := []string{}
+	server := rangeServer(t, payload, &ranges)
+	p, _ := testProvider(t, nil)
+	request := PullRequest{URL: server.URL, Size: int64(len(payload)), Checksum: "abcd"}
+	half := len(payload) / 2
+	if err := ioutil.WriteFile(downloadPath(p.dataDir, request.Checksum), payload[:half], 0600); err != nil {
+		t.Fatal(err)
+	}
+	dest, err := p.download(server.Client(), request)
+	if err != nil {
+		t.Fatalf("download failed: %v", err)
+	}
+	got, err := ioutil.ReadFile(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Errorf("resumed download differs from the served image")
+	}
+	expected := fmt.Sprintf("bytes=%d-", half)
+	if len(ranges) != 1 || ranges[0] != expected {
+		t.Errorf("expected a single %q request, got %q", expected, ranges)
+	}
+}
+
+// pullImage pulls a signed image announced with checksum, and returns the
+// status published by the provider.
+func pullImage(t *testing.T, image []byte, checksum string) (*provider, Status) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := gzipped(t, image)
+	ranges := []string{}
+	server := rangeServer(t, payload, &ranges)
+	p, client := testProvider(t, TrustedKeys{public})
+	meta := Metadata{Version: "1.1.0"}
+	digest := sha256.Sum256(image)
+	signature := ed25519.Sign(private, signedMessage(digest[:], meta))
+	request := PullRequest{URL: server.URL, Size: int64(len(payload)), Checksum: checksum, Metadata: meta}
+
+	p.pull(server.Client(), request, signature, meta)
+
+	status := Status{}
+	if err := json.Unmarshal(client.published[testPrefix+"status"], &status); err != nil {
+		t.Fatalf("no status was published: %v", err)
+	}
+	if status.To != checksum {
+		t.Errorf("status is about %s, expected %s", status.To, checksum)
+	}
+	if _, err := os.Stat(downloadPath(p.dataDir, checksum)); !os.IsNotExist(err) {
+		t.Errorf("download was not removed after the update")
+	}
+	entries := []Status{}
+	if err := json.Unmarshal(client.published[testPrefix+"history"], &entries); err != nil || len(entries) != 1 {
+		t.Errorf("update was not recorded in the history: %s", client.published[testPrefix+"history"])
+	}
+	return p, status
+}
+
+func TestPullChecksumMismatch(t *testing.T) {
+	image := bytes.Repeat([]byte("firmware"), 4096)
+	p, status := pullImage(t, image, checksum(t, []byte("other firmware")))
+	if status.Status != "BAD_CHECKSUM" {
+		t.Errorf("unexpected status: %+v", status)
+	}
+	select {
+	case <-p.rebootCh:
+		t.Errorf("reboot requested despite the checksum mismatch")
+	default:
+	}
+	if p.state != readyState {
+		t.Errorf("provider left in state %s", p.state)
+	}
+}
+
+func TestPullChecksumMatch(t *testing.T) {
+	if _, ok := elfTargets[runtime.GOARCH]; !ok {
+		t.Skipf("architecture checks are disabled on %s, the test would install the image", runtime.GOARCH)
+	}
+	// The image passes the checksum and signature checks, and is only
+	// refused because it is not an executable.
+	image := bytes.Repeat([]byte("firmware"), 4096)
+	_, status := pullImage(t, image, checksum(t, image))
+	if status.Status != "WRONG_ARCHITECTURE" {
+		t.Errorf("unexpected status: %+v", status)
+	}
+}
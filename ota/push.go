@@ -0,0 +1,351 @@
+package ota
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+var errTimeout = errors.New("timed out waiting for device")
+
+// Release is a firmware image ready to be pushed to devices.
+type Release struct {
+	Checksum  string
+	Signature string
+	Image     []byte
+	Metadata  Metadata
+}
+
+func LoadSigningKey(keyPath string) (ed25519.PrivateKey, error) {
+	buf, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(buf)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", keyPath)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signing key: %v", err)
+	}
+	signingKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("signing key %s is not an ed25519 key", keyPath)
+	}
+	return signingKey, nil
+}
+
+// NewRelease compresses the image at imagePath and signs it along with meta,
+// which cannot be changed afterwards.
+func NewRelease(imagePath string, meta Metadata, key ed25519.PrivateKey) (*Release, error) {
+	checksum, err := fingerprintFile(imagePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fingerprint %s: %v", imagePath, err)
+	}
+	file, err := os.Open(imagePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	digest := sha256.New()
+	buf := &bytes.Buffer{}
+	writer := gzip.NewWriter(buf)
+	_, err = io.Copy(io.MultiWriter(writer, digest), file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compress %s: %v", imagePath, err)
+	}
+	err = writer.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to compress %s: %v", imagePath, err)
+	}
+	release := &Release{Checksum: checksum, Image: buf.Bytes(), Metadata: meta}
+	if key != nil {
+		release.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, signedMessage(digest.Sum(nil), meta)))
+	}
+	return release, nil
+}
+
+type PushOptions struct {
+	// ChunkSize enables the chunked transfer protocol when positive.
+	ChunkSize int64
+	// DeltaDir is searched for <source>-<target>.bsdiff patches.
+	DeltaDir string
+	Timeout  time.Duration
+}
+
+type pusher struct {
+	client   mqtt.Client
+	prefix   string
+	release  *Release
+	options  PushOptions
+	status   chan Status
+	checksum chan string
+	missing  chan []int
+	acks     chan int
+}
+
+// Push sends release to the device rooted at deviceTopic, and waits for the
+// device to come back running it.
+func Push(client mqtt.Client, deviceTopic string, release *Release, options PushOptions) error {
+	p := &pusher{
+		client:   client,
+		prefix:   fmt.Sprintf("%s$implementation/ota/", deviceTopic),
+		release:  release,
+		options:  options,
+		status:   make(chan Status, 10),
+		checksum: make(chan string, 10),
+		missing:  make(chan []int, 10),
+		acks:     make(chan int, 100),
+	}
+	current := make(chan string, 1)
+	// Handlers run on the MQTT client goroutine, which must never block on a
+	// burst of messages nobody reads anymore: extra messages are dropped.
+	subscriptions := map[string]mqtt.MessageHandler{
+		"status": func(_ mqtt.Client, message mqtt.Message) {
+			status := Status{}
+			if message.Retained() || json.Unmarshal(message.Payload(), &status) != nil {
+				return
+			}
+			select {
+			case p.status <- status:
+			default:
+				log.Debugf("dropping OTA status %s", status.Status)
+			}
+		},
+		"checksum": func(_ mqtt.Client, message mqtt.Message) {
+			if message.Retained() {
+				select {
+				case current <- string(message.Payload()):
+				default:
+				}
+				return
+			}
+			select {
+			case p.checksum <- string(message.Payload()):
+			default:
+				log.Debugf("dropping OTA checksum %s", message.Payload())
+			}
+		},
+		"missing/" + release.Checksum: func(_ mqtt.Client, message mqtt.Message) {
+			missing := []int{}
+			if message.Retained() || json.Unmarshal(message.Payload(), &missing) != nil {
+				return
+			}
+			select {
+			case p.missing <- missing:
+			default:
+				log.Debugf("dropping OTA missing chunks report")
+			}
+		},
+		"ack/" + release.Checksum: func(_ mqtt.Client, message mqtt.Message) {
+			index, err := strconv.Atoi(string(message.Payload()))
+			if err != nil {
+				return
+			}
+			select {
+			case p.acks <- index:
+			default:
+				log.Debugf("dropping OTA acknowledgement of chunk %d", index)
+			}
+		},
+	}
+	topics := make([]string, 0, len(subscriptions))
+	defer func() {
+		if len(topics) > 0 {
+			client.Unsubscribe(topics...).WaitTimeout(5 * time.Second)
+		}
+	}()
+	for suffix, handler := range subscriptions {
+		token := client.Subscribe(p.prefix+suffix, 1, handler)
+		if token.Wait() && token.Error() != nil {
+			return token.Error()
+		}
+		topics = append(topics, p.prefix+suffix)
+	}
+
+	source := ""
+	select {
+	case source = <-current:
+	case <-time.After(5 * time.Second):
+	}
+	if source == release.Checksum {
+		log.Infof("%s is already running %s", deviceTopic, release.Checksum)
+		return nil
+	}
+	if release.Signature != "" {
+		err := p.publish("signature/"+release.Checksum, release.Signature)
+		if err != nil {
+			return err
+		}
+	}
+	meta, err := json.Marshal(release.Metadata)
+	if err != nil {
+		return err
+	}
+	err = p.publish("metadata/"+release.Checksum, meta)
+	if err != nil {
+		return err
+	}
+	status, err := p.send(source)
+	if err == nil && status.Status == "NO_MATCHING_DELTA" {
+		log.Warnf("no matching delta on %s, falling back to full image", deviceTopic)
+		status, err = p.send("")
+	}
+	if err != nil {
+		return err
+	}
+	if status.Code != 200 {
+		return fmt.Errorf("update refused by device: %d %s %s", status.Code, status.Status, status.Error)
+	}
+	log.Infof("%s accepted %s, waiting for it to come back", deviceTopic, release.Checksum)
+	deadline := time.After(p.options.Timeout)
+	for {
+		select {
+		case checksum := <-p.checksum:
+			if checksum == release.Checksum {
+				return nil
+			}
+		case status := <-p.status:
+			if status.Code != 200 {
+				return fmt.Errorf("update failed on device: %d %s %s", status.Code, status.Status, status.Error)
+			}
+		case <-deadline:
+			return errTimeout
+		}
+	}
+}
+
+func (p *pusher) publish(suffix string, payload interface{}) error {
+	token := p.client.Publish(p.prefix+suffix, 1, false, payload)
+	if !token.WaitTimeout(p.options.Timeout) {
+		return errTimeout
+	}
+	return token.Error()
+}
+
+func (p *pusher) waitStatus() (Status, error) {
+	select {
+	case status := <-p.status:
+		return status, nil
+	case <-time.After(p.options.Timeout):
+		return Status{}, errTimeout
+	}
+}
+
+// send publishes the release using a delta from source if one is available,
+// and returns the status reported by the device.
+func (p *pusher) send(source string) (Status, error) {
+	if source != "" && p.options.DeltaDir != "" {
+		patch, err := ioutil.ReadFile(path.Join(p.options.DeltaDir, fmt.Sprintf("%s-%s.bsdiff", source, p.release.Checksum)))
+		if err == nil {
+			log.Infof("sending %d bytes delta from %s", len(patch), source)
+			err = p.publish(fmt.Sprintf("delta/%s/%s", source, p.release.Checksum), patch)
+			if err != nil {
+				return Status{}, err
+			}
+			return p.waitStatus()
+		}
+	}
+	if p.options.ChunkSize <= 0 {
+		log.Infof("sending %d bytes image", len(p.release.Image))
+		err := p.publish("firmware/"+p.release.Checksum, p.release.Image)
+		if err != nil {
+			return Status{}, err
+		}
+		return p.waitStatus()
+	}
+	return p.sendChunks()
+}
+
+func (p *pusher) sendChunks() (Status, error) {
+	manifest := Manifest{
+		Checksum:  p.release.Checksum,
+		Size:      int64(len(p.release.Image)),
+		ChunkSize: p.options.ChunkSize,
+		Signature: p.release.Signature,
+		Metadata:  p.release.Metadata,
+	}
+	payload, err := json.Marshal(manifest)
+	if err != nil {
+		return Status{}, err
+	}
+	for attempt := 0; attempt < 3; attempt++ {
+		err = p.publish("manifest/"+manifest.Checksum, payload)
+		if err != nil {
+			return Status{}, err
+		}
+		var missing []int
+		select {
+		case missing = <-p.missing:
+		case status := <-p.status:
+			return status, nil
+		case <-time.After(p.options.Timeout):
+			return Status{}, errTimeout
+		}
+		log.Infof("sending %d missing chunks out of %d", len(missing), manifest.chunks())
+		err = p.sendMissing(manifest, missing)
+		if err == nil {
+			return p.waitStatus()
+		}
+		log.Warnf("chunked transfer interrupted, resuming: %v", err)
+	}
+	return Status{}, err
+}
+
+func (p *pusher) sendMissing(manifest Manifest, missing []int) error {
+	for _, index := range missing {
+		if index < 0 || index >= manifest.chunks() {
+			return errInvalidChunk
+		}
+		start := int64(index) * manifest.ChunkSize
+		end := start + manifest.ChunkSize
+		if end > manifest.Size {
+			end = manifest.Size
+		}
+		err := p.publish(fmt.Sprintf("chunk/%s/%d", manifest.Checksum, index), p.release.Image[start:end])
+		if err != nil {
+			return err
+		}
+		if err := p.waitAck(index); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *pusher) waitAck(index int) error {
+	deadline := time.After(p.options.Timeout)
+	for {
+		select {
+		case ack := <-p.acks:
+			if ack == index {
+				return nil
+			}
+		case <-deadline:
+			return fmt.Errorf("chunk %d was not acknowledged: %v", index, errTimeout)
+		}
+	}
+}
+
+// DeviceTopic returns the base topic of a device, following the layout used
+// by the agent.
+func DeviceTopic(baseTopic, name string) string {
+	return fmt.Sprintf("%s/%s/", strings.TrimSuffix(baseTopic, "/"), name)
+}
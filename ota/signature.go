@@ -0,0 +1,69 @@
+package ota
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	errNoTrustedKeys = errors.New("no trusted keys configured")
+	errUnsigned      = errors.New("firmware is not signed, or its signature was not received before it")
+	errBadSignature  = errors.New("firmware signature does not match any trusted key")
+)
+
+// TrustedKeys holds the ed25519 public keys allowed to sign firmware images.
+// A signature is computed over signedMessage, so that the version, channel
+// and force flag of a release cannot be changed without its signing key.
+type TrustedKeys []ed25519.PublicKey
+
+// signedMessage is the SHA-256 digest of the uncompressed image followed by
+// the JSON encoding of its metadata.
+func signedMessage(digest []byte, meta Metadata) []byte {
+	encoded, _ := json.Marshal(meta)
+	return append(append([]byte{}, digest...), encoded...)
+}
+
+func ParseTrustedKeys(encoded []string) (TrustedKeys, error) {
+	keys := make(TrustedKeys, 0, len(encoded))
+	for _, value := range encoded {
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode trusted key %q: %v", value, err)
+		}
+		if len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid trusted key %q: expected %d bytes, got %d", value, ed25519.PublicKeySize, len(key))
+		}
+		keys = append(keys, ed25519.PublicKey(key))
+	}
+	return keys, nil
+}
+
+func parseSignature(payload []byte) ([]byte, error) {
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(payload)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode signature: %v", err)
+	}
+	if len(signature) != ed25519.SignatureSize {
+		return nil, fmt.Errorf("invalid signature: expected %d bytes, got %d", ed25519.SignatureSize, len(signature))
+	}
+	return signature, nil
+}
+
+func (k TrustedKeys) verify(message []byte, signature []byte) error {
+	if len(k) == 0 {
+		return errNoTrustedKeys
+	}
+	if len(signature) == 0 {
+		return errUnsigned
+	}
+	for _, key := range k {
+		if ed25519.Verify(key, message, signature) {
+			return nil
+		}
+	}
+	return errBadSignature
+}
@@ -0,0 +1,143 @@
+package ota
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+)
+
+type Status struct {
+	Code        int       `json:"code"`
+	Status      string    `json:"status"`
+	From        string    `json:"from,omitempty"`
+	To          string    `json:"to,omitempty"`
+	FromVersion string    `json:"from_version,omitempty"`
+	ToVersion   string    `json:"to_version,omitempty"`
+	Timestamp   time.Time `json:"timestamp"`
+	Error       string    `json:"error,omitempty"`
+}
+
+func newStatus(from, to string, err error) Status {
+	status := Status{
+		From:      from,
+		To:        to,
+		Timestamp: time.Now().UTC(),
+	}
+	switch {
+	case err == nil:
+		status.Code, status.Status = 200, "OK"
+	case errors.Is(err, errChecksumMismatch):
+		status.Code, status.Status = 400, "BAD_CHECKSUM"
+	case errors.Is(err, errInvalidManifest):
+		status.Code, status.Status = 400, "BAD_MANIFEST"
+	case errors.Is(err, errInvalidPullRequest):
+		status.Code, status.Status = 400, "BAD_PULL_REQUEST"
+	case errors.Is(err, errMissingVersion):
+		status.Code, status.Status = 400, "MISSING_VERSION"
+	case errors.Is(err, errInvalidVersion):
+		status.Code, status.Status = 400, "BAD_VERSION"
+	case errors.Is(err, errDowngrade):
+		status.Code, status.Status = 409, "DOWNGRADE_REFUSED"
+	case errors.Is(err, errWrongChannel):
+		status.Code, status.Status = 403, "WRONG_CHANNEL"
+	case errors.Is(err, errInvalidPatch):
+		status.Code, status.Status = 400, "BAD_PATCH"
+	case errors.Is(err, errNoMatchingDelta):
+		status.Code, status.Status = 409, "NO_MATCHING_DELTA"
+	case errors.Is(err, errWrongArchitecture):
+		status.Code, status.Status = 422, "WRONG_ARCHITECTURE"
+	case errors.Is(err, errNoSpace):
+		status.Code, status.Status = 507, "INSUFFICIENT_STORAGE"
+	case errors.Is(err, errUnsigned):
+		status.Code, status.Status = 401, "UNSIGNED"
+	case errors.Is(err, errBadSignature):
+		status.Code, status.Status = 403, "BAD_SIGNATURE"
+	case errors.Is(err, errNoTrustedKeys):
+		status.Code, status.Status = 403, "NO_TRUSTED_KEYS"
+	default:
+		status.Code, status.Status = 500, "INTERNAL_ERROR"
+	}
+	if err != nil {
+		status.Error = err.Error()
+	}
+	return status
+}
+
+type Progress struct {
+	Phase    string `json:"phase"`
+	Received int64  `json:"received"`
+	Verified int64  `json:"verified"`
+	Total    int64  `json:"total"`
+}
+
+// progressReader counts the transferred bytes consumed by the decoder, so
+// that Verified grows up to Total, like Received.
+type progressReader struct {
+	p *provider
+	r io.Reader
+}
+
+func (r progressReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.p.progress.Verified += int64(n)
+	r.p.publishProgress(false)
+	return n, err
+}
+
+const defaultHistorySize = 10
+
+type history struct {
+	dir     string
+	size    int
+	entries []Status
+}
+
+func historyPath(dir string) string {
+	return path.Join(dir, "history.json")
+}
+
+func loadHistory(dir string, size int) *history {
+	if size <= 0 {
+		size = defaultHistorySize
+	}
+	h := &history{dir: dir, size: size, entries: []Status{}}
+	if dir == "" {
+		return h
+	}
+	buf, err := ioutil.ReadFile(historyPath(dir))
+	if err != nil {
+		return h
+	}
+	if json.Unmarshal(buf, &h.entries) != nil {
+		h.entries = []Status{}
+	}
+	return h
+}
+
+func (h *history) add(status Status) error {
+	h.entries = append(h.entries, status)
+	if len(h.entries) > h.size {
+		h.entries = h.entries[len(h.entries)-h.size:]
+	}
+	if h.dir == "" {
+		return nil
+	}
+	err := os.MkdirAll(h.dir, 0700)
+	if err != nil {
+		return err
+	}
+	buf, err := json.Marshal(h.entries)
+	if err != nil {
+		return err
+	}
+	tmp := historyPath(h.dir) + ".tmp"
+	err = ioutil.WriteFile(tmp, buf, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, historyPath(h.dir))
+}
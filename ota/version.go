@@ -0,0 +1,141 @@
+package ota
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var (
+	errMissingVersion = errors.New("firmware has no version metadata")
+	errInvalidVersion = errors.New("invalid firmware version")
+	errDowngrade      = errors.New("refusing to downgrade firmware")
+	errWrongChannel   = errors.New("firmware channel is not allowed on this device")
+)
+
+const DefaultChannel = "stable"
+
+// channels lists release channels from the most to the least stable. A device
+// accepts releases from its own channel and from any more stable one.
+var channels = []string{"stable", "beta"}
+
+func channelRank(channel string) int {
+	for idx, value := range channels {
+		if value == channel {
+			return idx
+		}
+	}
+	return -1
+}
+
+// Metadata describes a firmware release. It is published on
+// metadata/<checksum>, or embedded in manifests and pull requests, and is
+// covered by the firmware signature.
+type Metadata struct {
+	Version string `json:"version,omitempty"`
+	Channel string `json:"channel,omitempty"`
+	Force   bool   `json:"force,omitempty"`
+}
+
+type semver struct {
+	major, minor, patch int
+	prerelease          string
+}
+
+func parseVersion(value string) (semver, error) {
+	v := semver{}
+	value = strings.TrimPrefix(value, "v")
+	if idx := strings.IndexByte(value, '+'); idx >= 0 {
+		value = value[:idx]
+	}
+	if idx := strings.IndexByte(value, '-'); idx >= 0 {
+		v.prerelease = value[idx+1:]
+		value = value[:idx]
+	}
+	tokens := strings.Split(value, ".")
+	if len(tokens) != 3 {
+		return v, fmt.Errorf("%w: %q", errInvalidVersion, value)
+	}
+	numbers := make([]int, 3)
+	for idx, token := range tokens {
+		number, err := strconv.Atoi(token)
+		if err != nil || number < 0 {
+			return v, fmt.Errorf("%w: %q", errInvalidVersion, value)
+		}
+		numbers[idx] = number
+	}
+	v.major, v.minor, v.patch = numbers[0], numbers[1], numbers[2]
+	return v, nil
+}
+
+func (v semver) compare(o semver) int {
+	for _, diff := range []int{v.major - o.major, v.minor - o.minor, v.patch - o.patch} {
+		if diff != 0 {
+			return diff
+		}
+	}
+	switch {
+	case v.prerelease == o.prerelease:
+		return 0
+	case v.prerelease == "":
+		return 1
+	case o.prerelease == "":
+		return -1
+	default:
+		return comparePrerelease(v.prerelease, o.prerelease)
+	}
+}
+
+// comparePrerelease compares dot separated identifiers one by one: numeric
+// ones numerically and below alphanumeric ones, which compare as strings. A
+// shorter list of equal identifiers comes first.
+func comparePrerelease(a, b string) int {
+	left, right := strings.Split(a, "."), strings.Split(b, ".")
+	for idx := 0; idx < len(left) && idx < len(right); idx++ {
+		l, lErr := strconv.Atoi(left[idx])
+		r, rErr := strconv.Atoi(right[idx])
+		switch {
+		case lErr == nil && rErr == nil:
+			if l != r {
+				return l - r
+			}
+		case lErr == nil:
+			return -1
+		case rErr == nil:
+			return 1
+		default:
+			if c := strings.Compare(left[idx], right[idx]); c != 0 {
+				return c
+			}
+		}
+	}
+	return len(left) - len(right)
+}
+
+// checkPolicy decides whether a release may replace the running firmware.
+// Development builds, without a valid version, accept any release.
+func (p *provider) checkPolicy(meta Metadata) error {
+	if meta.Version == "" {
+		return errMissingVersion
+	}
+	target, err := parseVersion(meta.Version)
+	if err != nil {
+		return err
+	}
+	channel := meta.Channel
+	if channel == "" {
+		channel = DefaultChannel
+	}
+	if rank := channelRank(channel); rank < 0 || rank > channelRank(p.channel) {
+		return fmt.Errorf("%w: %s firmware on a %s device", errWrongChannel, channel, p.channel)
+	}
+	current, err := parseVersion(p.version)
+	if err != nil {
+		return nil
+	}
+	if target.compare(current) < 0 && !meta.Force {
+		return fmt.Errorf("%w from %s to %s", errDowngrade, p.version, meta.Version)
+	}
+	return nil
+}
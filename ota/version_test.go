@@ -0,0 +1,37 @@
+package ota
+
+import "testing"
+
+func TestCompareVersions(t *testing.T) {
+	for _, tc := range []struct {
+		a, b     string
+		expected int
+	}{
+		{"1.0.0", "1.0.0", 0},
+		{"1.0.1", "1.0.0", 1},
+		{"1.10.0", "1.9.0", 1},
+		{"v2.0.0", "1.99.99", 1},
+		{"1.0.0-rc.1", "1.0.0", -1},
+		{"1.0.0-rc.10", "1.0.0-rc.9", 1},
+		{"1.0.0-rc.9", "1.0.0-rc.10", -1},
+		{"1.0.0-1", "1.0.0-alpha", -1},
+		{"1.0.0-alpha", "1.0.0-alpha.1", -1},
+		{"1.0.0-alpha.1", "1.0.0-alpha.beta", -1},
+		{"1.0.0-alpha.beta", "1.0.0-beta", -1},
+		{"1.0.0-beta.11", "1.0.0-rc.1", -1},
+		{"1.0.0-rc.1+build.5", "1.0.0-rc.1", 0},
+	} {
+		a, err := parseVersion(tc.a)
+		if err != nil {
+			t.Fatalf("failed to parse %s: %v", tc.a, err)
+		}
+		b, err := parseVersion(tc.b)
+		if err != nil {
+			t.Fatalf("failed to parse %s: %v", tc.b, err)
+		}
+		got := a.compare(b)
+		if (got > 0) != (tc.expected > 0) || (got < 0) != (tc.expected < 0) {
+			t.Errorf("compare(%s, %s) = %d, expected %d", tc.a, tc.b, got, tc.expected)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"os"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/jbonachera/mqtt-laptop-agent/ota"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func otaCommand(config *viper.Viper) *cobra.Command {
+	otaCmd := &cobra.Command{
+		Use:   "ota",
+		Short: "Manage firmware updates",
+	}
+	pushCmd := &cobra.Command{
+		Use:   "push <firmware> <device>...",
+		Short: "Publish a firmware to one or more devices and wait for them to run it",
+		Args:  cobra.MinimumNArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			if v, _ := cmd.Flags().GetString("version"); v == "" {
+				return fmt.Errorf("--version is required")
+			}
+			var key ed25519.PrivateKey
+			keyPath, _ := cmd.Flags().GetString("signing-key")
+			if keyPath == "" {
+				keyPath = config.GetString("ota.signing-key")
+			}
+			if keyPath != "" {
+				var err error
+				key, err = ota.LoadSigningKey(keyPath)
+				if err != nil {
+					return err
+				}
+			} else {
+				fmt.Fprintln(os.Stderr, "warning: no signing key configured, devices will refuse this firmware")
+			}
+			meta := ota.Metadata{}
+			meta.Version, _ = cmd.Flags().GetString("version")
+			meta.Channel, _ = cmd.Flags().GetString("channel")
+			meta.Force, _ = cmd.Flags().GetBool("force")
+			release, err := ota.NewRelease(args[0], meta, key)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("firmware %s (%s): %d bytes compressed\n", release.Checksum, release.Metadata.Version, len(release.Image))
+
+			options, err := mqttClientOptions(config, fmt.Sprintf("agent-ota-push-%d", os.Getpid()))
+			if err != nil {
+				return err
+			}
+			client := mqtt.NewClient(options)
+			token := client.Connect()
+			if token.Wait() && token.Error() != nil {
+				return fmt.Errorf("failed to connect to MQTT: %v", token.Error())
+			}
+			defer client.Disconnect(250)
+
+			chunkSize, _ := cmd.Flags().GetInt("chunk-size")
+			deltaDir, _ := cmd.Flags().GetString("delta-dir")
+			timeout, _ := cmd.Flags().GetDuration("timeout")
+			pushOptions := ota.PushOptions{
+				ChunkSize: int64(chunkSize),
+				DeltaDir:  deltaDir,
+				Timeout:   timeout,
+			}
+			failed := 0
+			for _, name := range args[1:] {
+				fmt.Printf("%s: pushing %s\n", name, release.Checksum)
+				err := ota.Push(client, ota.DeviceTopic("devices", name), release, pushOptions)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "%s: update failed: %v\n", name, err)
+					failed++
+					continue
+				}
+				fmt.Printf("%s: running %s\n", name, release.Checksum)
+			}
+			if failed > 0 {
+				return fmt.Errorf("%d of %d devices failed to update", failed, len(args)-1)
+			}
+			return nil
+		},
+	}
+	pushCmd.Flags().String("signing-key", "", "path to the PEM-encoded ed25519 key used to sign the firmware")
+	pushCmd.Flags().Int("chunk-size", 0, "send the firmware in chunks of this many bytes")
+	pushCmd.Flags().String("delta-dir", "", "directory holding <source>-<target>.bsdiff patches")
+	pushCmd.Flags().Duration("timeout", 2*time.Minute, "how long to wait for each device")
+	pushCmd.Flags().String("version", "", "semantic version of the firmware")
+	pushCmd.Flags().String("channel", ota.DefaultChannel, "release channel of the firmware")
+	pushCmd.Flags().Bool("force", false, "allow devices to downgrade to this firmware")
+	otaCmd.AddCommand(pushCmd)
+	return otaCmd
+}
@@ -0,0 +1,371 @@
+package property
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	homie "github.com/jbonachera/homie-go/homie"
+	"github.com/jbonachera/mqtt-laptop-agent/logging"
+)
+
+var log = logging.New("property")
+
+// Datatype is one of the Homie v4 property datatypes.
+type Datatype string
+
+const (
+	Integer  Datatype = "integer"
+	Float    Datatype = "float"
+	Boolean  Datatype = "boolean"
+	String   Datatype = "string"
+	Enum     Datatype = "enum"
+	Color    Datatype = "color"
+	DateTime Datatype = "datetime"
+	Duration Datatype = "duration"
+)
+
+// Identified is implemented by nodes knowing their id, which is needed to
+// publish property attributes.
+type Identified interface {
+	ID() string
+}
+
+// Persister is implemented by properties whose values may be written to disk
+// while the broker is unreachable.
+type Persister interface {
+	SetPersistent(persistent bool)
+}
+
+// Builder declares a property and its Homie attributes.
+type Builder struct {
+	id         string
+	name       string
+	datatype   Datatype
+	format     string
+	unit       string
+	retained   bool
+	persistent bool
+}
+
+func New(id string, datatype Datatype) *Builder {
+	return &Builder{id: id, name: id, datatype: datatype, retained: true, persistent: true}
+}
+
+func (b *Builder) Name(name string) *Builder {
+	b.name = name
+	return b
+}
+
+func (b *Builder) Unit(unit string) *Builder {
+	b.unit = unit
+	return b
+}
+
+// Format sets $format, which is a range for numbers, the list of values for
+// enums and rgb or hsv for colors. On strings, it is the media type of
+// binary payloads, like image/jpeg for camera frames.
+func (b *Builder) Format(format string) *Builder {
+	b.format = format
+	return b
+}
+
+// Range is a shortcut for an integer range format.
+func (b *Builder) Range(min, max int) *Builder {
+	return b.Format(fmt.Sprintf("%d:%d", min, max))
+}
+
+// Retained declares whether the broker keeps the last value. Commands like
+// suspend should not be replayed to the device.
+func (b *Builder) Retained(retained bool) *Builder {
+	b.retained = retained
+	return b
+}
+
+// Persistent declares whether values queued while offline may be written to
+// disk. Large values which are stale once replayed, like camera frames, should
+// not.
+func (b *Builder) Persistent(persistent bool) *Builder {
+	b.persistent = persistent
+	return b
+}
+
+// Build creates the property on node. An invalid format is reported and
+// ignored, so that a provider does not fail because of a metadata error.
+func (b *Builder) Build(node homie.Node) homie.Property {
+	if err := checkFormat(b.datatype, b.format); err != nil {
+		log.Errorf("ignoring $format of property %s: %v", b.id, err)
+		b.format = ""
+	}
+	p := &Property{
+		Property: node.NewProperty(b.id, string(b.datatype)),
+		spec:     *b,
+		node:     node,
+	}
+	if persister, ok := p.Property.(Persister); ok {
+		persister.SetPersistent(b.persistent)
+	}
+	if identified, ok := node.(Identified); ok {
+		p.path = path.Join(identified.ID(), b.id)
+	}
+	register(p)
+	return p
+}
+
+// Property validates values against its datatype and format before they are
+// published, and set commands before they reach the handler.
+type Property struct {
+	homie.Property
+	mtx      sync.Mutex
+	spec     Builder
+	node     homie.Node
+	path     string
+	settable bool
+	handler  handlerFunc
+}
+
+func (p *Property) SetValue(value string) homie.Property {
+	if err := p.Validate(value); err != nil {
+		log.Errorf("refusing value %q of property %s: %v", value, p.spec.id, err)
+		return p
+	}
+	p.Property.SetValue(value)
+	return p
+}
+
+func (p *Property) Publish() homie.Property {
+	p.Property.Publish()
+	return p
+}
+
+// SetHandler makes the property settable. Set commands which do not match
+// the datatype or the format are rejected before reaching handler, and the
+// result of each command is published.
+func (p *Property) SetHandler(handler func(homie.Property, []byte, string) (bool, error)) {
+	p.mtx.Lock()
+	p.settable = true
+	p.handler = handler
+	p.mtx.Unlock()
+	p.publishAttributes()
+	p.subscribeCorrelated()
+	p.Property.SetHandler(func(_ homie.Property, payload []byte, topic string) (bool, error) {
+		return p.command(handler, payload, topic, "")
+	})
+}
+
+func (p *Property) attributes() map[string]string {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	attributes := map[string]string{
+		"$name":     p.spec.name,
+		"$datatype": string(p.spec.datatype),
+		"$settable": strconv.FormatBool(p.settable),
+		"$retained": strconv.FormatBool(p.spec.retained),
+	}
+	if p.spec.format != "" {
+		attributes["$format"] = p.spec.format
+	}
+	if p.spec.unit != "" {
+		attributes["$unit"] = p.spec.unit
+	}
+	return attributes
+}
+
+func (p *Property) publishAttributes() {
+	device := p.node.Device()
+	if p.path == "" || device == nil || device.Client() == nil || !device.Client().IsConnected() {
+		return
+	}
+	for attribute, value := range p.attributes() {
+		device.SendMessage(p.path+"/"+attribute, value)
+	}
+}
+
+var (
+	mtx        sync.Mutex
+	properties = map[string]*Property{}
+)
+
+func register(p *Property) {
+	if p.path == "" {
+		return
+	}
+	mtx.Lock()
+	properties[p.path] = p
+	mtx.Unlock()
+	p.publishAttributes()
+}
+
+// Announce publishes the attributes of every property and subscribes to their
+// correlated set commands. It is meant to be called on each connection, as
+// properties are usually created before.
+func Announce() {
+	mtx.Lock()
+	all := make([]*Property, 0, len(properties))
+	for _, p := range properties {
+		all = append(all, p)
+	}
+	mtx.Unlock()
+	for _, p := range all {
+		p.publishAttributes()
+		p.subscribeCorrelated()
+	}
+}
+
+// Unregister forgets the properties of the node nodeID and unsubscribes
+// from their correlated set commands. It is called when a provider stops, so
+// that its properties are not announced anymore.
+func Unregister(nodeID string) {
+	mtx.Lock()
+	removed := []*Property{}
+	for key, p := range properties {
+		if strings.HasPrefix(key, nodeID+"/") {
+			removed = append(removed, p)
+			delete(properties, key)
+		}
+	}
+	mtx.Unlock()
+	for _, p := range removed {
+		p.unsubscribeCorrelated()
+	}
+}
+
+var (
+	errNotInteger  = errors.New("not an integer")
+	errNotFloat    = errors.New("not a float")
+	errNotBoolean  = errors.New("not a boolean")
+	errOutOfRange  = errors.New("out of range")
+	errNotInEnum   = errors.New("not one of the allowed values")
+	errInvalidUTF8 = errors.New("not valid UTF-8")
+	durationRegexp = regexp.MustCompile(`^P(\d+(\.\d+)?D)?(T(\d+(\.\d+)?H)?(\d+(\.\d+)?M)?(\d+(\.\d+)?S)?)?$`)
+)
+
+func parseRange(format string) (min, max float64, err error) {
+	tokens := strings.SplitN(format, ":", 2)
+	if len(tokens) != 2 {
+		return 0, 0, fmt.Errorf("range %q is not <min>:<max>", format)
+	}
+	min, max = -1e308, 1e308
+	if tokens[0] != "" {
+		if min, err = strconv.ParseFloat(tokens[0], 64); err != nil {
+			return 0, 0, err
+		}
+	}
+	if tokens[1] != "" {
+		if max, err = strconv.ParseFloat(tokens[1], 64); err != nil {
+			return 0, 0, err
+		}
+	}
+	if min > max {
+		return 0, 0, fmt.Errorf("range %q is empty", format)
+	}
+	return min, max, nil
+}
+
+func checkFormat(datatype Datatype, format string) error {
+	switch datatype {
+	case Integer, Float:
+		if format == "" {
+			return nil
+		}
+		_, _, err := parseRange(format)
+		return err
+	case Enum:
+		if format == "" {
+			return errors.New("enum properties need a list of values")
+		}
+	case Color:
+		if format != "rgb" && format != "hsv" {
+			return fmt.Errorf("color format must be rgb or hsv, not %q", format)
+		}
+	case String:
+		if format == "" {
+			return nil
+		}
+		_, _, err := mime.ParseMediaType(format)
+		return err
+	}
+	return nil
+}
+
+func checkColor(format, value string) error {
+	tokens := strings.Split(value, ",")
+	if len(tokens) != 3 {
+		return fmt.Errorf("%s color needs 3 components", format)
+	}
+	limits := []int{255, 255, 255}
+	if format == "hsv" {
+		limits = []int{360, 100, 100}
+	}
+	for idx, token := range tokens {
+		v, err := strconv.Atoi(token)
+		if err != nil {
+			return errNotInteger
+		}
+		if v < 0 || v > limits[idx] {
+			return errOutOfRange
+		}
+	}
+	return nil
+}
+
+// Validate checks value against the datatype and format of the property.
+func (p *Property) Validate(value string) error {
+	spec := p.spec
+	switch spec.datatype {
+	case Integer, Float:
+		var v float64
+		if spec.datatype == Integer {
+			i, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return errNotInteger
+			}
+			v = float64(i)
+		} else {
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return errNotFloat
+			}
+			v = f
+		}
+		if spec.format != "" {
+			min, max, _ := parseRange(spec.format)
+			if v < min || v > max {
+				return fmt.Errorf("%v: %s", errOutOfRange, spec.format)
+			}
+		}
+	case Boolean:
+		if value != "true" && value != "false" {
+			return errNotBoolean
+		}
+	case Enum:
+		for _, allowed := range strings.Split(spec.format, ",") {
+			if value == allowed {
+				return nil
+			}
+		}
+		return fmt.Errorf("%v: %s", errNotInEnum, spec.format)
+	case Color:
+		return checkColor(spec.format, value)
+	case DateTime:
+		if _, err := time.Parse(time.RFC3339, value); err != nil {
+			return err
+		}
+	case Duration:
+		if !durationRegexp.MatchString(value) || value == "P" || strings.HasSuffix(value, "T") {
+			return fmt.Errorf("%q is not an ISO 8601 duration", value)
+		}
+	case String:
+		if spec.format == "" && !utf8.ValidString(value) {
+			return errInvalidUTF8
+		}
+	}
+	return nil
+}
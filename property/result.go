@@ -0,0 +1,104 @@
+package property
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	homie "github.com/jbonachera/homie-go/homie"
+)
+
+// Result is published on <node>/<property>/$result after each set command.
+// Commands sent to <node>/<property>/set/<id> carry id as correlation ID.
+type Result struct {
+	ID        string    `json:"id,omitempty"`
+	Value     string    `json:"value"`
+	Success   bool      `json:"success"`
+	Error     string    `json:"error,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+type handlerFunc func(homie.Property, []byte, string) (bool, error)
+
+// command validates and runs a set command, then reports its result. A
+// handler refusing a command without an error is reported as rejected.
+func (p *Property) command(handler handlerFunc, payload []byte, topic, id string) (bool, error) {
+	err := p.Validate(string(payload))
+	ok := false
+	if err != nil {
+		log.Warnf("rejecting set command %q on %s: %v", string(payload), topic, err)
+	} else {
+		ok, err = handler(p, payload, topic)
+		if err != nil {
+			log.Errorf("set command %q on %s failed: %v", string(payload), topic, err)
+		}
+	}
+	p.publishResult(Result{
+		ID:        id,
+		Value:     string(payload),
+		Success:   ok && err == nil,
+		Error:     errorMessage(ok, err),
+		Timestamp: time.Now().UTC(),
+	})
+	return ok, err
+}
+
+func errorMessage(ok bool, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	if !ok {
+		return "command rejected"
+	}
+	return ""
+}
+
+// publishResult sends r on $result, and its error message on $error so that
+// simple automations do not have to decode JSON.
+func (p *Property) publishResult(r Result) {
+	device := p.node.Device()
+	if p.path == "" || device == nil || device.Client() == nil || !device.Client().IsConnected() {
+		return
+	}
+	payload, err := json.Marshal(r)
+	if err != nil {
+		log.Errorf("failed to encode result of %s: %v", p.path, err)
+		return
+	}
+	device.SendMessage(p.path+"/$result", string(payload))
+	if !r.Success {
+		device.SendMessage(p.path+"/$error", r.Error)
+	}
+}
+
+// subscribeCorrelated handles the set commands carrying a correlation ID,
+// which the homie device does not subscribe to.
+func (p *Property) subscribeCorrelated() {
+	p.mtx.Lock()
+	handler := p.handler
+	p.mtx.Unlock()
+	device := p.node.Device()
+	if handler == nil || p.path == "" || device == nil || device.Client() == nil || !device.Client().IsConnected() {
+		return
+	}
+	device.Client().Subscribe(device.Topic(p.path+"/set/+"), 1, func(_ mqtt.Client, message mqtt.Message) {
+		topic := message.Topic()
+		id := topic[strings.LastIndex(topic, "/")+1:]
+		if ok, _ := p.command(handler, message.Payload(), topic, id); ok {
+			p.Property.SetValue(string(message.Payload()))
+			p.Property.Publish()
+		}
+	})
+}
+
+func (p *Property) unsubscribeCorrelated() {
+	p.mtx.Lock()
+	handler := p.handler
+	p.mtx.Unlock()
+	device := p.node.Device()
+	if handler == nil || p.path == "" || device == nil || device.Client() == nil || !device.Client().IsConnected() {
+		return
+	}
+	device.Client().Unsubscribe(device.Topic(p.path + "/set/+"))
+}
@@ -0,0 +1,156 @@
+package provider
+
+import (
+	"context"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/jbonachera/mqtt-laptop-agent/metrics"
+	"github.com/spf13/viper"
+)
+
+// BroadcastSubscriber lets a Broadcaster choose the broadcast levels it
+// receives, using path.Match patterns. Broadcasters which do not implement it
+// receive every level.
+type BroadcastSubscriber interface {
+	BroadcastLevels() []string
+}
+
+// Targets are the groups and tags of this device. A broadcast on
+// group/<group>/<level> or tag/<tag>/<level> is only delivered, as <level>,
+// to the devices having that group or tag.
+type Targets struct {
+	Groups []string
+	Tags   []string
+}
+
+func targetsFromConfig(config *viper.Viper) Targets {
+	return Targets{
+		Groups: config.GetStringSlice("broadcast.groups"),
+		Tags:   config.GetStringSlice("broadcast.tags"),
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve strips the target of level, and tells whether the broadcast is
+// meant for this device.
+func (t Targets) resolve(level string) (string, bool) {
+	tokens := strings.SplitN(level, "/", 3)
+	if len(tokens) < 3 {
+		return level, true
+	}
+	switch tokens[0] {
+	case "group":
+		return tokens[2], contains(t.Groups, tokens[1])
+	case "tag":
+		return tokens[2], contains(t.Tags, tokens[1])
+	}
+	return level, true
+}
+
+var droppedBroadcasts = metrics.NewCounterVec("agent_broadcasts_dropped_total", "Broadcasts left undelivered when a provider stopped, by provider.", "provider")
+
+// matchLevel tells whether level matches one of patterns. A nil patterns
+// matches every level, including the ones containing a slash.
+func matchLevel(patterns []string, level string) bool {
+	if patterns == nil {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, level); ok {
+			return true
+		}
+	}
+	return false
+}
+
+type broadcast struct {
+	level   string
+	payload []byte
+}
+
+// mailbox delivers broadcasts to a provider in order, from its own goroutine.
+// Its queue is unbounded, so that a slow provider applies back-pressure to its
+// own broadcasts only, and never to the MQTT client callback routing them.
+type mailbox struct {
+	ctx      context.Context
+	name     string
+	patterns []string
+	mtx      sync.Mutex
+	queue    []broadcast
+	wake     chan struct{}
+}
+
+func newMailbox(ctx context.Context, name string, broadcaster Broadcaster) *mailbox {
+	var patterns []string
+	if subscriber, ok := broadcaster.(BroadcastSubscriber); ok {
+		patterns = subscriber.BroadcastLevels()
+		if patterns == nil {
+			patterns = []string{}
+		}
+	}
+	m := &mailbox{ctx: ctx, name: name, patterns: patterns, wake: make(chan struct{}, 1)}
+	go func() {
+		for {
+			b, ok := m.next()
+			if !ok {
+				select {
+				case <-m.wake:
+					continue
+				case <-ctx.Done():
+					m.discard()
+					return
+				}
+			}
+			broadcaster.Broadcast(b.level, b.payload)
+		}
+	}()
+	return m
+}
+
+func (m *mailbox) next() (broadcast, bool) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if len(m.queue) == 0 || m.ctx.Err() != nil {
+		return broadcast{}, false
+	}
+	b := m.queue[0]
+	m.queue = m.queue[1:]
+	return b, true
+}
+
+// discard counts the broadcasts the provider did not receive before it
+// stopped.
+func (m *mailbox) discard() {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if len(m.queue) > 0 {
+		droppedBroadcasts.Add(m.name, float64(len(m.queue)))
+		m.queue = nil
+	}
+}
+
+// deliver queues b for the provider. It does not wait for the provider to
+// handle it.
+func (m *mailbox) deliver(b broadcast) {
+	if m.ctx.Err() != nil {
+		droppedBroadcasts.Inc(m.name)
+		return
+	}
+	m.mtx.Lock()
+	m.queue = append(m.queue, b)
+	m.mtx.Unlock()
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,378 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	homie "github.com/jbonachera/homie-go/homie"
+	"github.com/jbonachera/mqtt-laptop-agent/logging"
+	"github.com/jbonachera/mqtt-laptop-agent/property"
+	"github.com/jbonachera/mqtt-laptop-agent/rpc"
+	"github.com/spf13/viper"
+)
+
+var log = logging.New("provider")
+
+// Provider exposes a homie node backed by some local hardware or service.
+type Provider interface {
+	// Available tells whether the provider can run on this machine.
+	Available() bool
+	// Start registers the provider properties on node. Background work must
+	// end when ctx is cancelled.
+	Start(ctx context.Context, node homie.Node) error
+	Stop() error
+}
+
+// Broadcaster is implemented by providers reacting to homie broadcasts.
+type Broadcaster interface {
+	Broadcast(level string, payload []byte)
+}
+
+// Callable is implemented by providers exposing RPC methods. They are
+// registered as <provider>.<method> while the provider runs.
+type Callable interface {
+	Methods() []rpc.Method
+}
+
+// Configurable is implemented by providers reading settings from the
+// providers.<name> section of the configuration.
+type Configurable interface {
+	Configure(config *viper.Viper) error
+}
+
+type Definition struct {
+	// Name is used as the homie node id and as the configuration key.
+	Name     string
+	NodeType string
+	New      func() Provider
+}
+
+var (
+	mtx         sync.Mutex
+	definitions []Definition
+)
+
+// Register makes a provider known to every registry. It is meant to be called
+// from init functions.
+func Register(definition Definition) {
+	mtx.Lock()
+	defer mtx.Unlock()
+	for _, existing := range definitions {
+		if existing.Name == definition.Name {
+			panic(fmt.Sprintf("provider %s registered twice", definition.Name))
+		}
+	}
+	definitions = append(definitions, definition)
+}
+
+type entry struct {
+	Definition
+	provider Provider
+	cancel   context.CancelFunc
+	mailbox  *mailbox
+	methods  []string
+	started  bool
+	err      error
+}
+
+type Registry struct {
+	mtx     sync.Mutex
+	entries []*entry
+	ctx     context.Context
+	device  homie.Device
+	nodes   map[string]homie.Node
+	// settings holds the configuration each provider was created with,
+	// including the ones which are disabled or unavailable.
+	settings map[string]map[string]interface{}
+	targets  Targets
+	server   *rpc.Server
+}
+
+func configKey(name string) string {
+	return "providers." + name
+}
+
+func subConfig(config *viper.Viper, name string) *viper.Viper {
+	sub := config.Sub(configKey(name))
+	if sub == nil {
+		sub = viper.New()
+	}
+	return sub
+}
+
+func settings(config *viper.Viper, name string) map[string]interface{} {
+	return subConfig(config, name).AllSettings()
+}
+
+// newEntry instantiates definition if it is enabled in config and available
+// on this machine.
+func newEntry(config *viper.Viper, definition Definition) *entry {
+	key := configKey(definition.Name) + ".enabled"
+	if config.IsSet(key) && !config.GetBool(key) {
+		log.With("provider", definition.Name).Infof("provider is disabled")
+		return nil
+	}
+	p := definition.New()
+	if configurable, ok := p.(Configurable); ok {
+		err := configurable.Configure(subConfig(config, definition.Name))
+		if err != nil {
+			log.With("provider", definition.Name).Errorf("failed to configure provider: %v", err)
+			return nil
+		}
+	}
+	if !p.Available() {
+		log.With("provider", definition.Name).Infof("provider is not available on this machine")
+		return nil
+	}
+	return &entry{Definition: definition, provider: p}
+}
+
+// NewRegistry instantiates every registered provider which is enabled in
+// config and available on this machine.
+func NewRegistry(config *viper.Viper) *Registry {
+	mtx.Lock()
+	defer mtx.Unlock()
+	r := &Registry{
+		nodes:    map[string]homie.Node{},
+		settings: map[string]map[string]interface{}{},
+		targets:  targetsFromConfig(config),
+	}
+	for _, definition := range definitions {
+		r.settings[definition.Name] = settings(config, definition.Name)
+		if e := newEntry(config, definition); e != nil {
+			r.entries = append(r.entries, e)
+		}
+	}
+	return r
+}
+
+// node returns the homie node of a provider, reusing it across restarts.
+func (r *Registry) node(e *entry) homie.Node {
+	node, ok := r.nodes[e.Name]
+	if !ok {
+		node = r.device.NewNode(e.Name, e.NodeType)
+		r.nodes[e.Name] = node
+	}
+	return node
+}
+
+func (r *Registry) start(e *entry) {
+	ctx, cancel := context.WithCancel(r.ctx)
+	err := e.provider.Start(ctx, r.node(e))
+	if err != nil {
+		cancel()
+		log.With("provider", e.Name).Errorf("failed to start provider: %v", err)
+		e.err = err
+		return
+	}
+	e.cancel = cancel
+	e.started = true
+	e.err = nil
+	e.mailbox = nil
+	if broadcaster, ok := e.provider.(Broadcaster); ok {
+		e.mailbox = newMailbox(ctx, e.Name, broadcaster)
+	}
+	e.methods = nil
+	if callable, ok := e.provider.(Callable); ok && r.server != nil {
+		for _, m := range callable.Methods() {
+			m.Name = e.Name + "." + m.Name
+			r.server.Register(m)
+			e.methods = append(e.methods, m.Name)
+		}
+	}
+}
+
+// Serve registers the methods of the providers in server. It must be called
+// before Start.
+func (r *Registry) Serve(server *rpc.Server) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.server = server
+}
+
+func (r *Registry) Start(ctx context.Context, device homie.Device) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.ctx, r.device = ctx, device
+	for _, e := range r.entries {
+		r.start(e)
+	}
+}
+
+func (r *Registry) stopEntry(e *entry) {
+	for _, name := range e.methods {
+		r.server.Unregister(name)
+	}
+	property.Unregister(e.Name)
+	if e.cancel != nil {
+		e.cancel()
+	}
+	err := e.provider.Stop()
+	if err != nil {
+		log.With("provider", e.Name).Errorf("failed to stop provider: %v", err)
+	}
+}
+
+// Reload restarts the providers whose configuration changed, stops the ones
+// which were disabled and starts the ones which were enabled.
+func (r *Registry) Reload(config *viper.Viper) {
+	mtx.Lock()
+	defer mtx.Unlock()
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.targets = targetsFromConfig(config)
+	entries := []*entry{}
+	for _, definition := range definitions {
+		var current *entry
+		for _, e := range r.entries {
+			if e.Name == definition.Name {
+				current = e
+			}
+		}
+		updated := settings(config, definition.Name)
+		if reflect.DeepEqual(r.settings[definition.Name], updated) {
+			if current != nil {
+				entries = append(entries, current)
+			}
+			continue
+		}
+		r.settings[definition.Name] = updated
+		if current != nil {
+			log.With("provider", definition.Name).Infof("configuration changed, restarting provider")
+			if current.started {
+				r.stopEntry(current)
+			}
+		}
+		e := newEntry(config, definition)
+		if e == nil {
+			continue
+		}
+		if r.device != nil {
+			r.start(e)
+		}
+		entries = append(entries, e)
+	}
+	r.entries = entries
+}
+
+// Stop stops every running provider in parallel, giving up on the ones
+// which did not return within timeout.
+func (r *Registry) Stop(timeout time.Duration) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	wg := sync.WaitGroup{}
+	for _, e := range r.entries {
+		if !e.started {
+			continue
+		}
+		e.started = false
+		wg.Add(1)
+		go func(e *entry) {
+			defer wg.Done()
+			r.stopEntry(e)
+		}(e)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Warnf("some providers did not stop within %s", timeout)
+	}
+}
+
+// Broadcast delivers a homie broadcast to the providers subscribed to its
+// level. Each provider receives them in order from its own goroutine, so
+// that a slow provider does not block the caller nor the other providers.
+func (r *Registry) Broadcast(level string, payload []byte) {
+	r.mtx.Lock()
+	level, ok := r.targets.resolve(level)
+	mailboxes := []*mailbox{}
+	for _, e := range r.entries {
+		if ok && e.started && e.mailbox != nil && matchLevel(e.mailbox.patterns, level) {
+			mailboxes = append(mailboxes, e.mailbox)
+		}
+	}
+	r.mtx.Unlock()
+	for _, m := range mailboxes {
+		m.deliver(broadcast{level: level, payload: payload})
+	}
+}
+
+// Started returns the names of the running providers.
+func (r *Registry) Started() []string {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	names := []string{}
+	for _, e := range r.entries {
+		if e.started {
+			names = append(names, e.Name)
+		}
+	}
+	return names
+}
+
+// Failed returns the providers which failed to start, with their error.
+func (r *Registry) Failed() map[string]error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	failed := map[string]error{}
+	for _, e := range r.entries {
+		if e.err != nil {
+			failed[e.Name] = e.err
+		}
+	}
+	return failed
+}
+
+// Names returns the names of every registered provider.
+func Names() []string {
+	mtx.Lock()
+	defer mtx.Unlock()
+	names := make([]string, len(definitions))
+	for idx, definition := range definitions {
+		names[idx] = definition.Name
+	}
+	return names
+}
+
+// Availability tells whether a provider would run with a configuration.
+type Availability struct {
+	Name      string
+	Enabled   bool
+	Available bool
+	Err       error
+}
+
+// Probe checks every registered provider against config without starting
+// them.
+func Probe(config *viper.Viper) []Availability {
+	mtx.Lock()
+	defer mtx.Unlock()
+	result := []Availability{}
+	for _, definition := range definitions {
+		availability := Availability{Name: definition.Name, Enabled: true}
+		key := configKey(definition.Name) + ".enabled"
+		if config.IsSet(key) && !config.GetBool(key) {
+			availability.Enabled = false
+			result = append(result, availability)
+			continue
+		}
+		p := definition.New()
+		if configurable, ok := p.(Configurable); ok {
+			availability.Err = configurable.Configure(subConfig(config, definition.Name))
+		}
+		if availability.Err == nil {
+			availability.Available = p.Available()
+		}
+		p.Stop()
+		result = append(result, availability)
+	}
+	return result
+}
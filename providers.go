@@ -0,0 +1,8 @@
+package main
+
+// Providers living in their own package register themselves when imported.
+import (
+	_ "github.com/jbonachera/mqtt-laptop-agent/dafang"
+	_ "github.com/jbonachera/mqtt-laptop-agent/logind"
+	_ "github.com/jbonachera/mqtt-laptop-agent/upower"
+)
@@ -0,0 +1,77 @@
+package queue
+
+import (
+	homie "github.com/jbonachera/homie-go/homie"
+)
+
+type device struct {
+	homie.Device
+	queue *Queue
+}
+
+// WrapDevice returns a device whose node properties go through q when they
+// are published.
+func WrapDevice(d homie.Device, q *Queue) homie.Device {
+	return &device{Device: d, queue: q}
+}
+
+func (d *device) NewNode(id, name string) homie.Node {
+	return &node{Node: d.Device.NewNode(id, name), id: id, device: d}
+}
+
+type node struct {
+	homie.Node
+	id     string
+	device *device
+}
+
+func (n *node) ID() string {
+	return n.id
+}
+
+func (n *node) Device() homie.Device {
+	return n.device
+}
+
+func (n *node) NewProperty(id, datatype string) homie.Property {
+	return &property{Property: n.Node.NewProperty(id, datatype), key: n.id + "/" + id, node: n}
+}
+
+type property struct {
+	homie.Property
+	key   string
+	node  *node
+	value string
+}
+
+func (p *property) SetValue(value string) homie.Property {
+	p.value = value
+	p.Property.SetValue(value)
+	return p
+}
+
+func (p *property) Publish() homie.Property {
+	d := p.node.device
+	d.queue.Publish(d.Client(), p.key, d.Topic(p.key), []byte(p.value), true, func() {
+		p.Property.Publish()
+	})
+	return p
+}
+
+// SetPersistent keeps the values of the property in memory only while the
+// broker is unreachable when persistent is false.
+func (p *property) SetPersistent(persistent bool) {
+	if !persistent {
+		p.node.device.queue.SetVolatile(p.key)
+	}
+}
+
+func (p *property) SetHandler(handler func(homie.Property, []byte, string) (bool, error)) {
+	p.Property.SetHandler(func(_ homie.Property, payload []byte, topic string) (bool, error) {
+		ok, err := handler(p, payload, topic)
+		if ok {
+			p.value = string(payload)
+		}
+		return ok, err
+	})
+}
@@ -0,0 +1,290 @@
+package queue
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/jbonachera/mqtt-laptop-agent/logging"
+	"github.com/jbonachera/mqtt-laptop-agent/metrics"
+)
+
+var log = logging.New("queue")
+
+var (
+	published     = metrics.NewCounter("agent_mqtt_publish_total", "Property updates sent to the broker, including replayed ones.")
+	publishErrors = metrics.NewCounter("agent_mqtt_publish_errors_total", "Queued messages which failed to be replayed.")
+	queued        = metrics.NewGauge("agent_queue_length", "Messages waiting for the broker to come back.")
+	dropped       = metrics.NewCounter("agent_queue_dropped_total", "Messages dropped because the queue was full.")
+)
+
+// Policy tells what is kept for a property while the broker is unreachable.
+type Policy string
+
+const (
+	// Latest only keeps the last value of a property, which is enough for
+	// states like a battery level.
+	Latest Policy = "latest"
+	// History keeps every value, in order, for time-series and events.
+	History Policy = "history"
+)
+
+const DefaultSize = 1000
+
+// saveDelay batches the writes of the persisted queue: a laptop publishing
+// while offline must not rewrite the file on every property update.
+const saveDelay = 5 * time.Second
+
+func ParsePolicy(value string) (Policy, error) {
+	switch Policy(value) {
+	case Latest, History:
+		return Policy(value), nil
+	}
+	return "", fmt.Errorf("unknown queue policy %q", value)
+}
+
+type Message struct {
+	Topic     string    `json:"topic"`
+	Payload   []byte    `json:"payload"`
+	Retained  bool      `json:"retained"`
+	Timestamp time.Time `json:"timestamp"`
+	// Volatile messages are only kept in memory.
+	Volatile bool `json:"-"`
+}
+
+type Config struct {
+	// Path is where the queue is persisted. An empty Path keeps the queue in
+	// memory only.
+	Path string
+	// Size bounds the number of queued messages. Oldest messages are dropped
+	// first.
+	Size int
+	// Policies maps a "<node>/<property>" key to its policy, ignoring case.
+	// Properties which are not listed use Latest.
+	Policies map[string]Policy
+}
+
+// Queue buffers messages published while disconnected from the broker, and
+// replays them in order once the connection is back.
+type Queue struct {
+	mtx       sync.Mutex
+	config    Config
+	messages  []Message
+	replaying bool
+	dropped   int
+	saveTimer *time.Timer
+	volatile  map[string]bool
+}
+
+func New(config Config) *Queue {
+	if config.Size <= 0 {
+		config.Size = DefaultSize
+	}
+	policies := map[string]Policy{}
+	for key, policy := range config.Policies {
+		policies[strings.ToLower(key)] = policy
+	}
+	config.Policies = policies
+	q := &Queue{config: config, volatile: map[string]bool{}}
+	if config.Path != "" {
+		err := q.load()
+		if err != nil && !os.IsNotExist(err) {
+			log.Errorf("failed to load publish queue from %s: %v", config.Path, err)
+		}
+		if len(q.messages) > 0 {
+			log.Infof("loaded %d queued messages from %s", len(q.messages), config.Path)
+		}
+	}
+	return q
+}
+
+func (q *Queue) load() error {
+	buf, err := ioutil.ReadFile(q.config.Path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(buf, &q.messages)
+}
+
+// scheduleSave persists the queue after saveDelay, unless a save is already
+// scheduled. It must be called with q.mtx held.
+func (q *Queue) scheduleSave() {
+	queued.Set(float64(len(q.messages)))
+	if q.config.Path == "" || q.saveTimer != nil {
+		return
+	}
+	q.saveTimer = time.AfterFunc(saveDelay, func() {
+		q.mtx.Lock()
+		defer q.mtx.Unlock()
+		q.saveTimer = nil
+		q.save()
+	})
+}
+
+// Flush persists the queue right away. It is meant to be called before the
+// agent exits.
+func (q *Queue) Flush() {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	q.save()
+}
+
+// save must be called with q.mtx held.
+func (q *Queue) save() {
+	queued.Set(float64(len(q.messages)))
+	if q.saveTimer != nil {
+		q.saveTimer.Stop()
+		q.saveTimer = nil
+	}
+	if q.config.Path == "" {
+		return
+	}
+	persisted := make([]Message, 0, len(q.messages))
+	for _, message := range q.messages {
+		if !message.Volatile {
+			persisted = append(persisted, message)
+		}
+	}
+	if len(persisted) == 0 {
+		err := os.Remove(q.config.Path)
+		if err != nil && !os.IsNotExist(err) {
+			log.Errorf("failed to remove publish queue: %v", err)
+		}
+		return
+	}
+	buf, err := json.Marshal(persisted)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(q.config.Path), 0700)
+	}
+	if err == nil {
+		tmp := q.config.Path + ".tmp"
+		err = ioutil.WriteFile(tmp, buf, 0600)
+		if err == nil {
+			err = os.Rename(tmp, q.config.Path)
+		}
+	}
+	if err != nil {
+		log.Errorf("failed to persist publish queue: %v", err)
+	}
+}
+
+// SetVolatile keeps the messages of key out of the persisted queue. It suits
+// large values which are stale once replayed, like camera frames.
+func (q *Queue) SetVolatile(key string) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	q.volatile[strings.ToLower(key)] = true
+}
+
+func (q *Queue) policy(key string) Policy {
+	if policy, ok := q.config.Policies[strings.ToLower(key)]; ok {
+		return policy
+	}
+	return Latest
+}
+
+// Publish sends a message right away when client is connected and nothing is
+// waiting to be replayed, and queues it otherwise. key selects the policy.
+func (q *Queue) Publish(client mqtt.Client, key, topic string, payload []byte, retained bool, send func()) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	if client != nil && client.IsConnected() && !q.replaying && len(q.messages) == 0 {
+		send()
+		published.Inc()
+		return
+	}
+	if q.policy(key) == Latest {
+		for idx, message := range q.messages {
+			if message.Topic == topic {
+				q.messages = append(q.messages[:idx], q.messages[idx+1:]...)
+				break
+			}
+		}
+	}
+	volatile := q.volatile[strings.ToLower(key)]
+	q.messages = append(q.messages, Message{
+		Topic:     topic,
+		Payload:   payload,
+		Retained:  retained,
+		Timestamp: time.Now(),
+		Volatile:  volatile,
+	})
+	if len(q.messages) > q.config.Size {
+		volatile = false
+		if q.dropped == 0 {
+			log.Warnf("publish queue is full, dropping oldest messages")
+		}
+		q.dropped += len(q.messages) - q.config.Size
+		dropped.Add(float64(len(q.messages) - q.config.Size))
+		q.messages = q.messages[len(q.messages)-q.config.Size:]
+	}
+	if volatile {
+		queued.Set(float64(len(q.messages)))
+		return
+	}
+	q.scheduleSave()
+}
+
+// Len returns the number of messages waiting to be replayed.
+func (q *Queue) Len() int {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	return len(q.messages)
+}
+
+// Replay publishes queued messages in order. It stops at the first failure,
+// keeping the remaining messages for the next connection.
+func (q *Queue) Replay(client mqtt.Client) error {
+	q.mtx.Lock()
+	if q.replaying {
+		q.mtx.Unlock()
+		return nil
+	}
+	q.replaying = true
+	if len(q.messages) > 0 {
+		log.Infof("replaying %d queued messages", len(q.messages))
+	}
+	if q.dropped > 0 {
+		log.Warnf("%d messages were dropped while disconnected", q.dropped)
+		q.dropped = 0
+	}
+	q.mtx.Unlock()
+	defer func() {
+		q.mtx.Lock()
+		q.replaying = false
+		q.save()
+		q.mtx.Unlock()
+	}()
+	for {
+		q.mtx.Lock()
+		if len(q.messages) == 0 {
+			q.mtx.Unlock()
+			return nil
+		}
+		message := q.messages[0]
+		q.mtx.Unlock()
+		token := client.Publish(message.Topic, 1, message.Retained, message.Payload)
+		if !token.WaitTimeout(10 * time.Second) {
+			publishErrors.Inc()
+			return fmt.Errorf("timed out replaying message on %s", message.Topic)
+		}
+		if token.Error() != nil {
+			publishErrors.Inc()
+			return token.Error()
+		}
+		published.Inc()
+		q.mtx.Lock()
+		// Latest policy may have replaced the head while we were publishing.
+		if len(q.messages) > 0 && q.messages[0].Timestamp.Equal(message.Timestamp) && q.messages[0].Topic == message.Topic {
+			q.messages = q.messages[1:]
+		}
+		queued.Set(float64(len(q.messages)))
+		q.mtx.Unlock()
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"reflect"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	homie "github.com/jbonachera/homie-go/homie"
+	"github.com/jbonachera/mqtt-laptop-agent/logging"
+	"github.com/jbonachera/mqtt-laptop-agent/provider"
+	"github.com/spf13/viper"
+)
+
+// restartSections hold settings which are only read on startup.
+var restartSections = []string{"homie", "ota", "enroll", "queue", "http", "hass", "shutdown-timeout"}
+
+func sectionSettings(config *viper.Viper, key string) interface{} {
+	if sub := config.Sub(key); sub != nil {
+		return sub.AllSettings()
+	}
+	return config.Get(key)
+}
+
+func snapshot(config *viper.Viper, keys ...string) map[string]interface{} {
+	settings := map[string]interface{}{}
+	for _, key := range keys {
+		settings[key] = sectionSettings(config, key)
+	}
+	return settings
+}
+
+// reloader applies configuration changes to the running agent.
+type reloader struct {
+	mtx        sync.Mutex
+	config     *viper.Viper
+	device     homie.Device
+	providers  *provider.Registry
+	remoteLogs *logging.Remote
+	reconnect  func()
+	watching   bool
+	mqtt       map[string]interface{}
+	restart    map[string]interface{}
+}
+
+func newReloader(config *viper.Viper, device homie.Device, providers *provider.Registry, remoteLogs *logging.Remote, reconnect func()) *reloader {
+	return &reloader{
+		config:     config,
+		device:     device,
+		providers:  providers,
+		remoteLogs: remoteLogs,
+		reconnect:  reconnect,
+		mqtt:       snapshot(config, "mqtt"),
+		restart:    snapshot(config, restartSections...),
+	}
+}
+
+// Watch reloads the configuration whenever the file changes on disk.
+func (r *reloader) Watch() {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.watching || r.config.ConfigFileUsed() == "" {
+		return
+	}
+	r.watching = true
+	r.config.OnConfigChange(func(event fsnotify.Event) {
+		log.Infof("configuration file %s changed, reloading", event.Name)
+		r.Reload()
+	})
+	r.config.WatchConfig()
+}
+
+// Saved is called once a remote configuration fragment was written to disk.
+// The file watcher handles it, unless there was no configuration file when
+// the agent started.
+func (r *reloader) Saved() {
+	r.mtx.Lock()
+	watching := r.watching
+	r.mtx.Unlock()
+	if watching {
+		return
+	}
+	r.config.SetConfigFile(configPath())
+	if err := r.config.ReadInConfig(); err != nil {
+		log.Errorf("failed to load %s: %v", configPath(), err)
+		return
+	}
+	r.Watch()
+	r.Reload()
+}
+
+func (r *reloader) Reload() {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	for _, err := range validateFile(r.config.ConfigFileUsed()) {
+		log.Warnf("invalid configuration: %v", err)
+	}
+	applyCompat(r.config)
+	setupLogging(r.config)
+	if level, err := logging.ParseLevel(r.config.GetString("log.remote-level")); err == nil {
+		r.remoteLogs.SetLevel(level)
+	}
+	r.providers.Reload(r.config)
+
+	mqtt := snapshot(r.config, "mqtt")
+	if !reflect.DeepEqual(mqtt, r.mqtt) {
+		r.mqtt = mqtt
+		log.Infof("MQTT settings changed, reconnecting")
+		go r.reconnect()
+	}
+	restart := snapshot(r.config, restartSections...)
+	for _, key := range restartSections {
+		if !reflect.DeepEqual(restart[key], r.restart[key]) {
+			log.Warnf("changes to %s will only be applied after a restart", key)
+		}
+	}
+	r.restart = restart
+	if client := r.device.Client(); client != nil && client.IsConnected() {
+		publishConfig(r.device, r.config)
+	}
+}
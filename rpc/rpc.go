@@ -0,0 +1,214 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/jbonachera/mqtt-laptop-agent/logging"
+	"github.com/jbonachera/mqtt-laptop-agent/metrics"
+)
+
+var log = logging.New("rpc")
+
+var (
+	calls    = metrics.NewCounterVec("agent_rpc_calls_total", "RPC calls received, by result.", "result")
+	duration = metrics.NewHistogram("agent_rpc_call_seconds", "Time taken to run RPC methods.", metrics.DefaultBuckets)
+)
+
+const DefaultTimeout = 30 * time.Second
+
+// Handler runs a method with its JSON arguments. The returned value is
+// encoded as the JSON result. Handlers must return once ctx is done.
+type Handler func(ctx context.Context, args json.RawMessage) (interface{}, error)
+
+// Method is a procedure callable on $rpc/<name>. A zero timeout means
+// DefaultTimeout.
+type Method struct {
+	Name    string
+	Timeout time.Duration
+	Handler Handler
+}
+
+// Request is the payload of $rpc/<method>. MQTT v3 has no response topic nor
+// correlation data, so they are carried in the payload, with the same
+// meaning as their MQTT v5 counterpart.
+type Request struct {
+	Args            json.RawMessage `json:"args,omitempty"`
+	ResponseTopic   string          `json:"response_topic,omitempty"`
+	CorrelationData string          `json:"correlation_data,omitempty"`
+}
+
+// Response is published on the response topic of the request, or on
+// $rpc/<method>/response when the request has none.
+type Response struct {
+	CorrelationData string      `json:"correlation_data,omitempty"`
+	Result          interface{} `json:"result,omitempty"`
+	Error           string      `json:"error,omitempty"`
+}
+
+var (
+	ErrUnknownMethod          = errors.New("unknown method")
+	ErrTimeout                = errors.New("method timed out")
+	ErrForbiddenResponseTopic = errors.New("response topic not allowed")
+)
+
+// Server dispatches the requests received on $rpc/+ to the registered
+// methods.
+type Server struct {
+	mtx      sync.Mutex
+	ctx      context.Context
+	topic    func(path string) string
+	methods  map[string]Method
+	prefixes []string
+}
+
+// New returns a server whose topics are returned by topic. Running calls are
+// cancelled with ctx.
+func New(ctx context.Context, topic func(path string) string) *Server {
+	s := &Server{ctx: ctx, topic: topic, methods: map[string]Method{}}
+	s.Register(Method{Name: "rpc.list", Handler: s.list})
+	return s
+}
+
+// AllowResponsePrefix lets requests have their response published below
+// prefix, in addition to the $rpc/ subtree of the device.
+func (s *Server) AllowResponsePrefix(prefix string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.prefixes = append(s.prefixes, prefix)
+}
+
+// checkResponseTopic makes sure a request cannot make the device publish, with
+// its own credentials, on topics like the set commands of other devices.
+// Topics directly below $rpc/ are requests, so responses must be deeper.
+func (s *Server) checkResponseTopic(topic string) error {
+	if strings.ContainsAny(topic, "+#") {
+		return fmt.Errorf("%w: %s", ErrForbiddenResponseTopic, topic)
+	}
+	if rest := strings.TrimPrefix(topic, s.topic("$rpc/")); rest != topic && strings.Contains(rest, "/") {
+		return nil
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for _, prefix := range s.prefixes {
+		if strings.HasPrefix(topic, prefix) && len(topic) > len(prefix) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrForbiddenResponseTopic, topic)
+}
+
+// Register makes m callable, replacing any method with the same name.
+func (s *Server) Register(m Method) {
+	if m.Timeout == 0 {
+		m.Timeout = DefaultTimeout
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.methods[m.Name] = m
+}
+
+func (s *Server) Unregister(name string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	delete(s.methods, name)
+}
+
+func (s *Server) list(ctx context.Context, args json.RawMessage) (interface{}, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	names := make([]string, 0, len(s.methods))
+	for name := range s.methods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Attach subscribes to the requests through client. It must be called on
+// each connection. Retained requests are ignored, or they would run again
+// on every connection.
+func (s *Server) Attach(client mqtt.Client) {
+	client.Subscribe(s.topic("$rpc/+"), 1, func(client mqtt.Client, message mqtt.Message) {
+		if message.Retained() {
+			return
+		}
+		topic := message.Topic()
+		name := topic[strings.LastIndex(topic, "/")+1:]
+		go s.handle(client, name, message.Payload())
+	})
+}
+
+func (s *Server) handle(client mqtt.Client, name string, payload []byte) {
+	request := Request{}
+	if len(payload) > 0 {
+		if err := json.Unmarshal(payload, &request); err != nil {
+			log.Warnf("ignoring malformed request for %s: %v", name, err)
+			calls.Inc("malformed")
+			return
+		}
+	}
+	defaultTopic := s.topic(fmt.Sprintf("$rpc/%s/response", name))
+	if request.ResponseTopic == "" {
+		request.ResponseTopic = defaultTopic
+	}
+	response := Response{CorrelationData: request.CorrelationData}
+	if err := s.checkResponseTopic(request.ResponseTopic); err != nil {
+		log.Warnf("refusing request for %s: %v", name, err)
+		calls.Inc("forbidden")
+		response.Error = err.Error()
+		encoded, _ := json.Marshal(response)
+		client.Publish(defaultTopic, 1, false, encoded)
+		return
+	}
+	result, err := s.Call(name, request.Args)
+	if err != nil {
+		response.Error = err.Error()
+		calls.Inc("error")
+	} else {
+		response.Result = result
+		calls.Inc("success")
+	}
+	encoded, err := json.Marshal(response)
+	if err != nil {
+		log.Errorf("failed to encode response of %s: %v", name, err)
+		encoded, _ = json.Marshal(Response{CorrelationData: request.CorrelationData, Error: err.Error()})
+	}
+	client.Publish(request.ResponseTopic, 1, false, encoded)
+}
+
+// Call runs a method, giving up once its timeout is reached.
+func (s *Server) Call(name string, args json.RawMessage) (interface{}, error) {
+	s.mtx.Lock()
+	m, ok := s.methods[name]
+	s.mtx.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("%v: %s", ErrUnknownMethod, name)
+	}
+	defer duration.Since(time.Now())
+	ctx, cancel := context.WithTimeout(s.ctx, m.Timeout)
+	defer cancel()
+	type outcome struct {
+		result interface{}
+		err    error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		result, err := m.Handler(ctx, args)
+		done <- outcome{result, err}
+	}()
+	select {
+	case o := <-done:
+		return o.result, o.err
+	case <-ctx.Done():
+		log.Warnf("method %s did not return within %s", name, m.Timeout)
+		return nil, fmt.Errorf("%v after %s", ErrTimeout, m.Timeout)
+	}
+}
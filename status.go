@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jbonachera/mqtt-laptop-agent/metrics"
+	"github.com/jbonachera/mqtt-laptop-agent/provider"
+)
+
+var (
+	connectionAttempts = metrics.NewCounter("agent_mqtt_connection_attempts_total", "Attempts to connect to a broker.")
+	connectionFailures = metrics.NewCounter("agent_mqtt_connection_failures_total", "Failed connections and lost connections.")
+	reconnects         = metrics.NewCounter("agent_mqtt_reconnects_total", "Connections established after the first one.")
+	connectedGauge     = metrics.NewGauge("agent_mqtt_connected", "Whether the agent is connected to a broker.")
+)
+
+// connectivity tracks the broker connection for the health endpoints.
+type connectivity struct {
+	mtx       sync.Mutex
+	connected bool
+	since     time.Time
+	connects  int
+}
+
+func newConnectivity() *connectivity {
+	return &connectivity{since: time.Now()}
+}
+
+func (c *connectivity) Set(connected bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if connected {
+		if c.connects > 0 {
+			reconnects.Inc()
+		}
+		c.connects++
+		connectedGauge.Set(1)
+	} else {
+		connectedGauge.Set(0)
+	}
+	if c.connected != connected {
+		c.connected = connected
+		c.since = time.Now()
+	}
+}
+
+func (c *connectivity) Get() (bool, time.Time) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.connected, c.since
+}
+
+type healthReport struct {
+	Connected bool              `json:"connected"`
+	Since     time.Time         `json:"since"`
+	Providers []string          `json:"providers"`
+	Failed    map[string]string `json:"failed,omitempty"`
+}
+
+func writeReport(w http.ResponseWriter, ok bool, report healthReport) {
+	w.Header().Set("Content-Type", "application/json")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+// serveStatus exposes /healthz, /readyz and /metrics on addr until ctx is
+// done. The agent is healthy as long as it was not disconnected for longer
+// than unhealthyAfter, and ready when connected with every provider running.
+func serveStatus(ctx context.Context, addr string, conn *connectivity, providers *provider.Registry, unhealthyAfter time.Duration) {
+	report := func() healthReport {
+		connected, since := conn.Get()
+		failed := map[string]string{}
+		for name, err := range providers.Failed() {
+			failed[name] = err.Error()
+		}
+		return healthReport{Connected: connected, Since: since.UTC(), Providers: providers.Started(), Failed: failed}
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		status := report()
+		writeReport(w, status.Connected || time.Since(status.Since) < unhealthyAfter, status)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		status := report()
+		writeReport(w, status.Connected && len(status.Failed) == 0, status)
+	})
+	mux.Handle("/metrics", metrics.Handler())
+	server := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+	go func() {
+		log.Infof("serving health and metrics on %s", addr)
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			log.Errorf("failed to serve health and metrics: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+func isTLSBroker(broker string) bool {
+	for _, scheme := range []string{"ssl://", "tls://", "tcps://", "mqtts://", "wss://"} {
+		if strings.HasPrefix(broker, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// tlsLoader holds the client certificate and the certificate authorities
+// stored under tlsPath(), and reloads them when they change on disk.
+type tlsLoader struct {
+	mtx      sync.Mutex
+	cert     *tls.Certificate
+	leaf     *x509.Certificate
+	roots    *x509.CertPool
+	modTimes map[string]time.Time
+}
+
+func newTLSLoader() (*tlsLoader, error) {
+	l := &tlsLoader{}
+	return l, l.load()
+}
+
+func fileModTimes(paths ...string) map[string]time.Time {
+	modTimes := map[string]time.Time{}
+	for _, path := range paths {
+		if stat, err := os.Stat(path); err == nil {
+			modTimes[path] = stat.ModTime()
+		}
+	}
+	return modTimes
+}
+
+func (l *tlsLoader) load() error {
+	modTimes := fileModTimes(caPath(), certPath(), privkeyPath())
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+	if _, ok := modTimes[caPath()]; ok {
+		buf, err := ioutil.ReadFile(caPath())
+		if err != nil {
+			return fmt.Errorf("failed to read CA bundle: %v", err)
+		}
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(buf) {
+			return fmt.Errorf("no certificate found in %s", caPath())
+		}
+	}
+	var cert *tls.Certificate
+	var leaf *x509.Certificate
+	_, hasCert := modTimes[certPath()]
+	_, hasKey := modTimes[privkeyPath()]
+	if hasCert && hasKey {
+		pair, err := tls.LoadX509KeyPair(certPath(), privkeyPath())
+		if err != nil {
+			return fmt.Errorf("failed to load client certificate: %v", err)
+		}
+		leaf, err = x509.ParseCertificate(pair.Certificate[0])
+		if err != nil {
+			return fmt.Errorf("failed to parse client certificate: %v", err)
+		}
+		cert = &pair
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.roots, l.cert, l.leaf, l.modTimes = roots, cert, leaf, modTimes
+	return nil
+}
+
+// Expiry returns the expiration date of the client certificate, or a zero
+// time if there is none.
+func (l *tlsLoader) Expiry() time.Time {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.leaf == nil {
+		return time.Time{}
+	}
+	return l.leaf.NotAfter
+}
+
+// Config returns a tls.Config always using the latest loaded certificates.
+// The server certificate is verified manually so that a reloaded CA bundle
+// is taken into account on the next connection.
+func (l *tlsLoader) Config(broker string) (*tls.Config, error) {
+	u, err := url.Parse(broker)
+	if err != nil {
+		return nil, err
+	}
+	serverName := u.Hostname()
+	return &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			l.mtx.Lock()
+			defer l.mtx.Unlock()
+			if l.cert == nil {
+				return &tls.Certificate{}, nil
+			}
+			return l.cert, nil
+		},
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return l.verify(serverName, rawCerts)
+		},
+	}, nil
+}
+
+func (l *tlsLoader) verify(serverName string, rawCerts [][]byte) error {
+	if len(rawCerts) == 0 {
+		return errors.New("broker did not present any certificate")
+	}
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for idx, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return fmt.Errorf("failed to parse broker certificate: %v", err)
+		}
+		certs[idx] = cert
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	l.mtx.Lock()
+	roots := l.roots
+	l.mtx.Unlock()
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		DNSName:       serverName,
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+	return err
+}
+
+// Watch polls the TLS files and reloads them when they change.
+func (l *tlsLoader) Watch(interval time.Duration, onReload func()) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			current := fileModTimes(caPath(), certPath(), privkeyPath())
+			l.mtx.Lock()
+			changed := len(current) != len(l.modTimes)
+			for path, modTime := range current {
+				if !l.modTimes[path].Equal(modTime) {
+					changed = true
+				}
+			}
+			l.mtx.Unlock()
+			if !changed {
+				continue
+			}
+			err := l.load()
+			if err != nil {
+				log.Errorf("failed to reload TLS files: %v", err)
+				continue
+			}
+			log.Infof("TLS files reloaded, they will be used on next connection")
+			onReload()
+		}
+	}()
+}
@@ -1,46 +1,77 @@
 package upower
 
 import (
+	"context"
 	"fmt"
-	"os"
 
-	"github.com/go-acme/lego/log"
 	dbus "github.com/godbus/dbus"
 	homie "github.com/jbonachera/homie-go/homie"
+	"github.com/jbonachera/mqtt-laptop-agent/metrics"
+	"github.com/jbonachera/mqtt-laptop-agent/property"
+	"github.com/jbonachera/mqtt-laptop-agent/provider"
 )
 
+var dbusSignals = metrics.NewCounter("agent_upower_dbus_signals_total", "D-Bus signals received by the upower provider.")
+
+func init() {
+	provider.Register(provider.Definition{
+		Name:     "upower",
+		NodeType: "upower",
+		New: func() provider.Provider {
+			return NewUpowerProvider()
+		},
+	})
+}
+
 type upowerProvider struct {
+	conn *dbus.Conn
 }
 
 func NewUpowerProvider() *upowerProvider {
 	return &upowerProvider{}
 }
 
-func (l *upowerProvider) Serve(node homie.Node) {
-	conn, err := dbus.ConnectSystemBus()
-	if err != nil {
-		fmt.Fprintln(os.Stderr, "Failed to connect to system bus:", err)
-		return
+func (l *upowerProvider) battery() dbus.BusObject {
+	return l.conn.Object("org.freedesktop.UPower", "/org/freedesktop/UPower/devices/battery_BAT0")
+}
+
+func (l *upowerProvider) Available() bool {
+	if l.conn == nil {
+		conn, err := dbus.ConnectSystemBus()
+		if err != nil {
+			return false
+		}
+		l.conn = conn
 	}
-	obj := conn.Object("org.freedesktop.UPower", "/org/freedesktop/UPower/devices/battery_BAT0")
-	result, err := obj.GetProperty("org.freedesktop.UPower.Device.Percentage")
+	_, err := l.battery().GetProperty("org.freedesktop.UPower.Device.Percentage")
+	return err == nil
+}
+
+func (l *upowerProvider) Start(ctx context.Context, node homie.Node) error {
+	if l.conn == nil {
+		return fmt.Errorf("not connected to system bus")
+	}
+	result, err := l.battery().GetProperty("org.freedesktop.UPower.Device.Percentage")
 	if err != nil {
-		log.Print(err)
+		return err
+	}
+	suspend := property.New("batteryPercentage", property.Float).Unit("%").Format("0:100").Build(node)
+	if value, ok := result.Value().(float64); ok {
+		suspend.SetValue(fmt.Sprintf("%.2f", value))
 	}
-	suspend := node.NewProperty("batteryPercentage", "float64")
-	suspend.SetValue(fmt.Sprintf("%.2f", result.Value().(float64)))
 
-	if err := conn.AddMatchSignal(
+	if err := l.conn.AddMatchSignal(
 		dbus.WithMatchInterface("org.freedesktop.DBus.Properties"),
 	); err != nil {
-		panic(err)
+		return err
 	}
 	c := make(chan *dbus.Signal, 0)
 
-	conn.Signal(c)
+	l.conn.Signal(c)
 
 	go func() {
 		for event := range c {
+			dbusSignals.Inc()
 			if len(event.Body) >= 2 {
 				if v, ok := event.Body[0].(string); ok && v == "org.freedesktop.UPower.Device" {
 					value := event.Body[1].(map[string]dbus.Variant)["Percentage"].Value()
@@ -51,5 +82,14 @@ func (l *upowerProvider) Serve(node homie.Node) {
 			}
 		}
 	}()
+	return nil
+}
 
+func (l *upowerProvider) Stop() error {
+	if l.conn == nil {
+		return nil
+	}
+	err := l.conn.Close()
+	l.conn = nil
+	return err
 }
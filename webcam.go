@@ -2,11 +2,12 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"image"
 	"image/jpeg"
-	"log"
 	"os"
 	"os/exec"
 	"sort"
@@ -14,8 +15,23 @@ import (
 
 	"github.com/blackjack/webcam"
 	homie "github.com/jbonachera/homie-go/homie"
+	"github.com/jbonachera/mqtt-laptop-agent/metrics"
+	"github.com/jbonachera/mqtt-laptop-agent/property"
+	"github.com/jbonachera/mqtt-laptop-agent/provider"
+	"github.com/jbonachera/mqtt-laptop-agent/rpc"
+	"github.com/spf13/viper"
 )
 
+func init() {
+	provider.Register(provider.Definition{
+		Name:     "webcam",
+		NodeType: "camera",
+		New: func() provider.Provider {
+			return &webcamProvider{path: "/dev/video0"}
+		},
+	})
+}
+
 const (
 	V4L2_PIX_FMT_PJPG = 0x47504A50
 	V4L2_PIX_FMT_YUYV = 0x56595559
@@ -44,7 +60,16 @@ var supportedFormats = map[webcam.PixelFormat]bool{
 	V4L2_PIX_FMT_YUYV: true,
 }
 
-func (provider *webcamProvider) Capturer(limit int, cb func([]byte)) error {
+var captureDuration = metrics.NewHistogram("agent_webcam_capture_seconds", "Time taken to capture a webcam frame.", metrics.DefaultBuckets)
+
+func (provider *webcamProvider) Capturer(ctx context.Context, limit int, cb func([]byte)) error {
+	return provider.capture(ctx, limit, 0, 0, cb)
+}
+
+// capture grabs frames of width x height, or of the largest supported size
+// when they are zero, until limit frames were captured or ctx is done.
+func (provider *webcamProvider) capture(ctx context.Context, limit, width, height int, cb func([]byte)) error {
+	defer captureDuration.Since(time.Now())
 	cam, err := webcam.Open(provider.path) // Open webcam
 	if err != nil {
 		if _, err := os.Stat("/system/sdcard/bin/getimage"); err == nil {
@@ -55,9 +80,9 @@ func (provider *webcamProvider) Capturer(limit int, cb func([]byte)) error {
 				cb(out.Bytes())
 				return nil
 			}
-			log.Println(err)
+			log.Errorf("%v", err)
 		} else {
-			log.Println(err)
+			log.Errorf("%v", err)
 		}
 		return fmt.Errorf("failed to open webcam: %v", err)
 	}
@@ -70,13 +95,22 @@ func (provider *webcamProvider) Capturer(limit int, cb func([]byte)) error {
 		return errors.New("No matching frame size, exiting")
 	}
 
-	_, w, h, err := cam.SetImageFormat(V4L2_PIX_FMT_YUYV, uint32(size.MaxWidth), uint32(size.MaxHeight))
+	if width == 0 || height == 0 {
+		width, height = int(size.MaxWidth), int(size.MaxHeight)
+	}
+	_, w, h, err := cam.SetImageFormat(V4L2_PIX_FMT_YUYV, uint32(width), uint32(height))
 	if err != nil {
 		return errors.New("SetImageFormat return error")
 	}
 	err = cam.StartStreaming()
+	if err != nil {
+		return fmt.Errorf("failed to start streaming: %v", err)
+	}
 	count := 0
 	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		count++
 		err = cam.WaitForFrame(5000)
 
@@ -85,7 +119,7 @@ func (provider *webcamProvider) Capturer(limit int, cb func([]byte)) error {
 		case *webcam.Timeout:
 			continue
 		default:
-			panic(err.Error())
+			return fmt.Errorf("failed to wait for frame: %v", err)
 		}
 
 		frame, err := cam.ReadFrame()
@@ -120,27 +154,84 @@ type webcamProvider struct {
 	path string
 }
 
-func (w *webcamProvider) RegisterNode(device homie.Device) {
+func (w *webcamProvider) Configure(config *viper.Viper) error {
+	if path := config.GetString("path"); path != "" {
+		w.path = path
+	}
+	return nil
+}
+
+func (w *webcamProvider) Available() bool {
+	if _, err := os.Stat(w.path); err == nil {
+		return true
+	}
+	_, err := os.Stat("/system/sdcard/bin/getimage")
+	return err == nil
+}
+
+type captureArgs struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+type captureResult struct {
+	ContentType string `json:"content_type"`
+	Frame       []byte `json:"frame"`
+}
+
+func (w *webcamProvider) Methods() []rpc.Method {
+	return []rpc.Method{
+		{Name: "capture", Timeout: 20 * time.Second, Handler: w.captureMethod},
+	}
+}
+
+// captureMethod returns a frame, base64 encoded, at the requested size.
+func (w *webcamProvider) captureMethod(ctx context.Context, args json.RawMessage) (interface{}, error) {
+	parsed := captureArgs{}
+	if len(args) > 0 {
+		if err := json.Unmarshal(args, &parsed); err != nil {
+			return nil, err
+		}
+	}
+	if parsed.Width < 0 || parsed.Height < 0 {
+		return nil, errors.New("width and height must be positive")
+	}
+	result := captureResult{ContentType: "image/jpeg"}
+	err := w.capture(ctx, 1, parsed.Width, parsed.Height, func(b []byte) {
+		result.Frame = b
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (w *webcamProvider) Stop() error {
+	return nil
+}
+
+func (w *webcamProvider) Start(ctx context.Context, node homie.Node) error {
 	var v string
-	err := w.Capturer(1, func(b []byte) {
+	err := w.Capturer(ctx, 1, func(b []byte) {
 		v = string(b)
 	})
 	if err != nil {
-		log.Print(err)
-		return
+		return err
 	}
-	node := device.NewNode("webcam", "camera")
 	trigger := make(chan struct{}, 1)
-	frame := node.NewProperty("frame", "jpeg")
+	frame := property.New("frame", property.String).Format("image/jpeg").Persistent(false).Build(node)
 	frame.SetValue(v)
 	go func() {
 		ticker := time.NewTicker(1 * time.Hour)
+		defer ticker.Stop()
 		for {
 			select {
 			case <-ticker.C:
 			case <-trigger:
+			case <-ctx.Done():
+				return
 			}
-			w.Capturer(1, func(b []byte) {
+			w.Capturer(ctx, 1, func(b []byte) {
 				frame.SetValue(string(b)).Publish()
 			})
 		}
@@ -153,4 +244,5 @@ func (w *webcamProvider) RegisterNode(device homie.Device) {
 		}
 		return true, nil
 	})
+	return nil
 }